@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/auth"
+	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/hub"
+	"github.com/icexin/dueros/iface"
+	"github.com/icexin/dueros/proto"
+	"github.com/icexin/dueros/web"
+)
+
+// apiError 是返回给客户端的错误，code为http状态码
+type apiError struct {
+	code int
+	err  error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func newAPIError(code int, format string, args ...interface{}) error {
+	return &apiError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+var errNotRunning = newAPIError(http.StatusServiceUnavailable, "dueros is not running")
+
+// apiHandler 处理一个api请求，返回的结果以json输出
+type apiHandler func(r *http.Request) (interface{}, error)
+
+// checkRequest 拒绝其他网站的页面发起的请求。修改状态的请求必须是application/json，
+// 浏览器跨域发送这样的请求之前需要预检，其他网站的页面不能直接提交表单控制设备
+func checkRequest(r *http.Request) error {
+	if !hub.CheckOrigin(r) {
+		return newAPIError(http.StatusForbidden, "origin not allowed")
+	}
+	if r.Method == "GET" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return newAPIError(http.StatusUnsupportedMediaType, "content type must be application/json")
+	}
+	return nil
+}
+
+// handleAPI 注册pattern的处理函数，methods为每个http方法的处理函数
+func handleAPI(pattern string, methods map[string]apiHandler) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		h, ok := methods[r.Method]
+		if !ok {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if err := checkRequest(r); err != nil {
+			writeJSON(w, err.(*apiError).code, map[string]string{"error": err.Error()})
+			return
+		}
+		ret, err := h(r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if e, ok := err.(*apiError); ok {
+				code = e.code
+			}
+			writeJSON(w, code, map[string]string{"error": err.Error()})
+			return
+		}
+		if ret == nil {
+			ret = map[string]string{"result": "ok"}
+		}
+		writeJSON(w, http.StatusOK, ret)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body: %s", err)
+	}
+	return nil
+}
+
+// Status 是/api/status返回的设备状态
+type Status struct {
+	Connected     bool                `json:"connected"`
+	Authorized    bool                `json:"authorized"`
+	PendingEvents int                 `json:"pendingEvents"`
+	Player        *iface.PlayerStatus `json:"player,omitempty"`
+	Volume        *Volume             `json:"volume,omitempty"`
+	Alerts        []proto.Alert       `json:"alerts,omitempty"`
+}
+
+// Volume 是/api/volume的请求和返回，请求中为空的字段不修改
+type Volume struct {
+	Volume *int  `json:"volume,omitempty"`
+	Muted  *bool `json:"muted,omitempty"`
+}
+
+func getStatus(r *http.Request) (interface{}, error) {
+	var status Status
+	if duer.OS != nil {
+		status.Connected = duer.OS.Connected()
+		status.PendingEvents = duer.OS.PendingEvents()
+	}
+	_, err := auth.GetToken()
+	status.Authorized = err == nil
+	if player, err := iface.DefaultRegistry.AudioPlayer(); err == nil {
+		s := player.Status()
+		status.Player = &s
+	}
+	if speaker, err := iface.DefaultRegistry.SpeakerController(); err == nil {
+		status.Volume = currentVolume(speaker)
+	}
+	if alerts, err := iface.DefaultRegistry.Alerts(); err == nil {
+		status.Alerts = alerts.List()
+	}
+	return status, nil
+}
+
+func postListen(r *http.Request) (interface{}, error) {
+	if duer.OS == nil || audio.DefaultRecorder == nil {
+		return nil, errNotRunning
+	}
+	voiceInput, err := iface.DefaultRegistry.VoiceInput()
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	if voiceInput.Listening() {
+		return nil, newAPIError(http.StatusConflict, "already listening")
+	}
+	w := Wakeup{
+		Position: audio.DefaultRecorder.Position(),
+		Profile:  proto.ProfileNearField,
+		Method:   "api",
+	}
+	err = listen(w)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"dialogRequestId": voiceInput.DialogRequestId()}, nil
+}
+
+func postText(r *http.Request) (interface{}, error) {
+	var req struct {
+		Query string `json:"query"`
+	}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, newAPIError(http.StatusBadRequest, "empty query")
+	}
+	if duer.OS == nil {
+		return nil, errNotRunning
+	}
+	voiceInput, err := iface.DefaultRegistry.VoiceInput()
+	if err != nil {
+		return nil, err
+	}
+	if voiceOutput, err := iface.DefaultRegistry.VoiceOutput(); err == nil {
+		voiceOutput.Interrupt()
+	}
+	m := proto.NewMessage(proto.NamespaceTextInput+".TextInput", &proto.TextInputPayload{
+		Query: req.Query,
+	})
+	m.Header.DialogRequestId = voiceInput.StartDialog()
+	duer.OS.PostEvent(m)
+	return map[string]string{"dialogRequestId": m.Header.DialogRequestId}, nil
+}
+
+// playerAction 返回暂停、继续和停止播放的处理函数
+func playerAction(action func(p *iface.AudioPlayer) error) apiHandler {
+	return func(r *http.Request) (interface{}, error) {
+		if duer.OS == nil {
+			return nil, errNotRunning
+		}
+		player, err := iface.DefaultRegistry.AudioPlayer()
+		if err != nil {
+			return nil, newAPIError(http.StatusNotFound, "%s", err)
+		}
+		err = action(player)
+		if err != nil {
+			return nil, err
+		}
+		return player.Status(), nil
+	}
+}
+
+func currentVolume(speaker *iface.SpeakerController) *Volume {
+	volume, muted := speaker.Volume()
+	return &Volume{Volume: &volume, Muted: &muted}
+}
+
+func getVolume(r *http.Request) (interface{}, error) {
+	speaker, err := iface.DefaultRegistry.SpeakerController()
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	return currentVolume(speaker), nil
+}
+
+func putVolume(r *http.Request) (interface{}, error) {
+	var req Volume
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Volume != nil && (*req.Volume < 0 || *req.Volume > 100) {
+		return nil, newAPIError(http.StatusBadRequest, "volume must be in [0, 100]")
+	}
+	speaker, err := iface.DefaultRegistry.SpeakerController()
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	if req.Volume != nil {
+		speaker.SetVolume(*req.Volume)
+	}
+	if req.Muted != nil {
+		speaker.SetMute(*req.Muted)
+	}
+	return currentVolume(speaker), nil
+}
+
+func getAlerts(r *http.Request) (interface{}, error) {
+	alerts, err := iface.DefaultRegistry.Alerts()
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	return alerts.List(), nil
+}
+
+func deleteAlert(r *http.Request) (interface{}, error) {
+	token := strings.TrimPrefix(r.URL.Path, "/api/alerts/")
+	if token == "" {
+		return nil, newAPIError(http.StatusBadRequest, "missing alert token")
+	}
+	alerts, err := iface.DefaultRegistry.Alerts()
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	err = alerts.Delete(token)
+	if err == iface.ErrAlertNotFound {
+		return nil, newAPIError(http.StatusNotFound, "%s", err)
+	}
+	return nil, err
+}
+
+// setupapi 注册/api下的控制接口和网页，需要在duer.OS创建之后调用，
+// 这样接口中读取duer.OS不会和创建的时候竞争
+func setupapi() {
+	http.Handle("/", web.Handler())
+	handleAPI("/api/status", map[string]apiHandler{"GET": getStatus})
+	handleAPI("/api/listen", map[string]apiHandler{"POST": postListen})
+	handleAPI("/api/text", map[string]apiHandler{"POST": postText})
+	handleAPI("/api/player/pause", map[string]apiHandler{"POST": playerAction(func(p *iface.AudioPlayer) error {
+		return p.Pause(nil)
+	})})
+	handleAPI("/api/player/resume", map[string]apiHandler{"POST": playerAction(func(p *iface.AudioPlayer) error {
+		return p.Resume(nil)
+	})})
+	handleAPI("/api/player/stop", map[string]apiHandler{"POST": playerAction(func(p *iface.AudioPlayer) error {
+		return p.Stop(nil)
+	})})
+	handleAPI("/api/volume", map[string]apiHandler{"GET": getVolume, "PUT": putVolume})
+	handleAPI("/api/alerts", map[string]apiHandler{"GET": getAlerts})
+	handleAPI("/api/alerts/", map[string]apiHandler{"DELETE": deleteAlert})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckRequest(t *testing.T) {
+	cases := []struct {
+		method      string
+		origin      string
+		contentType string
+		code        int
+	}{
+		{"GET", "", "", 0},
+		{"GET", "http://pi.local:8080", "", 0},
+		{"GET", "http://evil.example.com", "", http.StatusForbidden},
+		{"POST", "", "application/json", 0},
+		{"PUT", "", "application/json; charset=utf-8", 0},
+		{"POST", "http://pi.local:8080", "application/json", 0},
+		{"POST", "", "", http.StatusUnsupportedMediaType},
+		{"POST", "", "text/plain", http.StatusUnsupportedMediaType},
+		{"DELETE", "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"POST", "http://evil.example.com", "application/json", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "http://pi.local:8080/api/text", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		code := 0
+		if err := checkRequest(r); err != nil {
+			code = err.(*apiError).code
+		}
+		if code != c.code {
+			t.Errorf("%s %q %q: expect %d, got %d", c.method, c.origin, c.contentType, c.code, code)
+		}
+	}
+}
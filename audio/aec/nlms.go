@@ -0,0 +1,144 @@
+// Package aec 实现了回声消除，用扬声器播放的声音作为参考信号，从麦克风的录音中去掉回声
+package aec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// DefaultTaps 是默认的滤波器长度，16k采样率下可以覆盖64ms的回声
+	DefaultTaps = 1024
+	// DefaultStep 是默认的步长，越大收敛越快，但是稳定之后的残留回声也越大
+	DefaultStep = 0.5
+)
+
+// NLMS 是归一化最小均方自适应滤波器，用参考信号估计回声并从录音中减去
+type NLMS struct {
+	mu float64
+	// 滤波器系数
+	w []float64
+	// 参考信号的历史，环形缓冲区，pos为最新的采样
+	x   []float64
+	pos int
+	// 参考信号历史的能量
+	power float64
+}
+
+// NewNLMS 创建一个长度为taps、步长为mu的滤波器
+func NewNLMS(taps int, mu float64) *NLMS {
+	return &NLMS{
+		mu: mu,
+		w:  make([]float64, taps),
+		x:  make([]float64, taps),
+	}
+}
+
+// Process 用参考信号ref消除mic中的回声，结果写入out，三者的长度需要相同，out可以和mic相同
+func (f *NLMS) Process(mic, ref, out []int16) {
+	const eps = 1e-6
+	n := len(f.x)
+	for i := range mic {
+		f.pos++
+		if f.pos == n {
+			f.pos = 0
+		}
+		x := float64(ref[i]) / 32768
+		old := f.x[f.pos]
+		f.x[f.pos] = x
+		f.power += x*x - old*old
+		if f.power < 0 {
+			f.power = 0
+		}
+
+		// 估计回声
+		var y float64
+		idx := f.pos
+		for k := range f.w {
+			y += f.w[k] * f.x[idx]
+			idx--
+			if idx < 0 {
+				idx = n - 1
+			}
+		}
+
+		e := float64(mic[i])/32768 - y
+
+		// 更新滤波器系数
+		g := f.mu * e / (f.power + eps)
+		idx = f.pos
+		for k := range f.w {
+			f.w[k] += g * f.x[idx]
+			idx--
+			if idx < 0 {
+				idx = n - 1
+			}
+		}
+		out[i] = clip(e * 32768)
+	}
+}
+
+// Reset 清除已经学习到的回声路径
+func (f *NLMS) Reset() {
+	for i := range f.w {
+		f.w[i] = 0
+		f.x[i] = 0
+	}
+	f.power = 0
+}
+
+func clip(v float64) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
+
+// Canceller 和audio.EchoCanceller相同，定义在这里避免依赖audio包
+type Canceller interface {
+	Process(mic, ref, out []int16)
+}
+
+// ProcessPCM 对little endian的16位单声道pcm数据做回声消除，mic和ref按照采样对齐，
+// 用于离线处理录制的文件，ref比mic短的部分当作静音
+func ProcessPCM(c Canceller, mic, ref io.Reader, out io.Writer) error {
+	const frames = 160
+	micbuf := make([]byte, frames*2)
+	refbuf := make([]byte, frames*2)
+	m := make([]int16, frames)
+	r := make([]int16, frames)
+	for {
+		n, err := io.ReadFull(mic, micbuf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		n /= 2
+		for i := range refbuf {
+			refbuf[i] = 0
+		}
+		_, rerr := io.ReadFull(ref, refbuf[:n*2])
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		for i := 0; i < n; i++ {
+			m[i] = int16(binary.LittleEndian.Uint16(micbuf[i*2:]))
+			r[i] = int16(binary.LittleEndian.Uint16(refbuf[i*2:]))
+		}
+		c.Process(m[:n], r[:n], m[:n])
+		for i := 0; i < n; i++ {
+			binary.LittleEndian.PutUint16(micbuf[i*2:], uint16(m[i]))
+		}
+		if _, err := out.Write(micbuf[:n*2]); err != nil {
+			return err
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
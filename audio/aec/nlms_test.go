@@ -0,0 +1,94 @@
+package aec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// echo 模拟扬声器到麦克风的回声路径：延迟加衰减
+func echo(ref []int16) []int16 {
+	ir := map[int]float64{12: 0.5, 40: -0.2, 100: 0.1}
+	out := make([]int16, len(ref))
+	for i := range out {
+		var v float64
+		for d, g := range ir {
+			if i >= d {
+				v += g * float64(ref[i-d])
+			}
+		}
+		out[i] = clip(v)
+	}
+	return out
+}
+
+func energy(s []int16) float64 {
+	var e float64
+	for _, v := range s {
+		e += float64(v) * float64(v)
+	}
+	return e
+}
+
+func noise(n int) []int16 {
+	rnd := rand.New(rand.NewSource(1))
+	s := make([]int16, n)
+	for i := range s {
+		s[i] = int16(rnd.NormFloat64() * 3000)
+	}
+	return s
+}
+
+func TestNLMSCancelEcho(t *testing.T) {
+	const rate = 16000
+	ref := noise(rate * 3)
+	mic := echo(ref)
+	out := make([]int16, len(mic))
+	NewNLMS(256, DefaultStep).Process(mic, ref, out)
+
+	// 收敛之后的回声衰减
+	tail := len(mic) - rate
+	erle := 10 * math.Log10(energy(mic[tail:])/energy(out[tail:]))
+	if erle < 20 {
+		t.Errorf("expect erle >= 20dB, got %.1fdB", erle)
+	}
+}
+
+func TestNLMSKeepNearEnd(t *testing.T) {
+	mic := make([]int16, 1600)
+	for i := range mic {
+		mic[i] = int16(10000 * math.Sin(float64(i)/10))
+	}
+	ref := make([]int16, len(mic))
+	out := make([]int16, len(mic))
+	NewNLMS(DefaultTaps, DefaultStep).Process(mic, ref, out)
+	for i := range mic {
+		if d := int(mic[i]) - int(out[i]); d > 1 || d < -1 {
+			t.Fatalf("near end changed at %d: %d != %d", i, out[i], mic[i])
+		}
+	}
+}
+
+func toPCM(s []int16) []byte {
+	buf := make([]byte, len(s)*2)
+	for i, v := range s {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(v))
+	}
+	return buf
+}
+
+func TestProcessPCM(t *testing.T) {
+	ref := noise(16000*2 + 33)
+	mic := echo(ref)
+	out := new(bytes.Buffer)
+	// ref比mic短的部分当作静音
+	err := ProcessPCM(NewNLMS(256, DefaultStep), bytes.NewReader(toPCM(mic)), bytes.NewReader(toPCM(ref[:16000])), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != len(mic)*2 {
+		t.Fatalf("expect %d bytes, got %d", len(mic)*2, out.Len())
+	}
+}
@@ -42,7 +42,7 @@ func TestRecordAndPlay(t *testing.T) {
 
 func TestPlayMP3(t *testing.T) {
 	p := NewPlayer()
-	w, err := p.LoadMP3File("testdata/Dota2_music_ui_main_02.mp3")
+	w, err := p.LoadMP3("testdata/Dota2_music_ui_main_02.mp3")
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,201 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+var (
+	// InputDevice 是录音使用的设备，可以是设备的序号、名字或者名字的一部分，为空的时候使用默认设备
+	InputDevice string
+	// OutputDevice 是播放使用的设备，格式同InputDevice，默认取自环境变量DUEROS_OUT
+	OutputDevice = os.Getenv("DUEROS_OUT")
+)
+
+// 检查设备支持的采样率时尝试的采样率
+var commonRates = []int{8000, 16000, 22050, 32000, 44100, 48000}
+
+// Device 描述一个音频设备
+type Device struct {
+	Index             int
+	Name              string
+	HostApi           string
+	MaxInputChannels  int
+	MaxOutputChannels int
+	DefaultSampleRate float64
+	// 单声道16位录音和播放支持的采样率
+	InputRates  []int
+	OutputRates []int
+
+	DefaultInput  bool
+	DefaultOutput bool
+}
+
+// ListDevices 返回所有的音频设备
+func ListDevices() ([]Device, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	defaultIn, _ := portaudio.DefaultInputDevice()
+	defaultOut, _ := portaudio.DefaultOutputDevice()
+	var ret []Device
+	for i, info := range devices {
+		d := Device{
+			Index:             i,
+			Name:              info.Name,
+			MaxInputChannels:  info.MaxInputChannels,
+			MaxOutputChannels: info.MaxOutputChannels,
+			DefaultSampleRate: info.DefaultSampleRate,
+			DefaultInput:      info == defaultIn,
+			DefaultOutput:     info == defaultOut,
+		}
+		if info.HostApi != nil {
+			d.HostApi = info.HostApi.Name
+		}
+		if info.MaxInputChannels > 0 {
+			d.InputRates = supportedRates(info, true)
+		}
+		if info.MaxOutputChannels > 0 {
+			d.OutputRates = supportedRates(info, false)
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+func supportedRates(info *portaudio.DeviceInfo, input bool) []int {
+	var rates []int
+	for _, rate := range commonRates {
+		var p portaudio.StreamParameters
+		if input {
+			p = portaudio.LowLatencyParameters(info, nil)
+			p.Input.Channels = 1
+		} else {
+			p = portaudio.LowLatencyParameters(nil, info)
+			p.Output.Channels = 1
+		}
+		p.SampleRate = float64(rate)
+		var err error
+		if input {
+			err = portaudio.IsFormatSupported(p, make([]int16, 1))
+		} else {
+			err = portaudio.IsFormatSupported(p, func(out []int16) {})
+		}
+		if err == nil {
+			rates = append(rates, rate)
+		}
+	}
+	return rates
+}
+
+// FindDevice 按照序号、名字或者名字的一部分(不区分大小写)查找录音或者播放设备，spec为空的时候返回默认设备
+func FindDevice(spec string, input bool) (*portaudio.DeviceInfo, error) {
+	if spec == "" {
+		if input {
+			return portaudio.DefaultInputDevice()
+		}
+		return portaudio.DefaultOutputDevice()
+	}
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	usable := func(d *portaudio.DeviceInfo) bool {
+		if input {
+			return d.MaxInputChannels > 0
+		}
+		return d.MaxOutputChannels > 0
+	}
+	kind := "output"
+	if input {
+		kind = "input"
+	}
+
+	if i, err := strconv.Atoi(spec); err == nil {
+		if i < 0 || i >= len(devices) || !usable(devices[i]) {
+			return nil, fmt.Errorf("no %s device with index %d", kind, i)
+		}
+		return devices[i], nil
+	}
+	for _, d := range devices {
+		if usable(d) && d.Name == spec {
+			return d, nil
+		}
+	}
+	var matches []*portaudio.DeviceInfo
+	for _, d := range devices {
+		if usable(d) && strings.Contains(strings.ToLower(d.Name), strings.ToLower(spec)) {
+			matches = append(matches, d)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no %s device matches %q", kind, spec)
+	case 1:
+		return matches[0], nil
+	default:
+		var names []string
+		for _, d := range matches {
+			names = append(names, strconv.Quote(d.Name))
+		}
+		return nil, fmt.Errorf("%s device %q is ambiguous: %s", kind, spec, strings.Join(names, ", "))
+	}
+}
+
+// PlayTone 在OutputDevice上播放频率为freq的正弦波，用于检查播放设备
+func PlayTone(freq float64, d time.Duration) error {
+	const rate = 16000
+	n := int(int64(rate) * int64(d) / int64(time.Second))
+	buf := make([]byte, n*2)
+	for i := 0; i < n; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*freq*float64(i)/rate))
+		buf[i*2] = byte(v)
+		buf[i*2+1] = byte(uint16(v) >> 8)
+	}
+	w, err := NewWriter(rate, 1, buf)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return w.Play()
+}
+
+// Loopback 从DefaultRecorder录音d时长之后播放出来，返回录音的峰值(0-32767)，用于检查录音设备
+func Loopback(d time.Duration) (int, error) {
+	err := OpenDefaultRecorder()
+	if err != nil {
+		return 0, err
+	}
+	stream := DefaultRecorder.NewStream()
+	buf := make([]byte, durationBytes(DefaultRecorder.rate, DefaultRecorder.channel, d))
+	// 一次读取的数据不能超过录音缓冲区，io.ReadFull分多次读取
+	_, err = io.ReadFull(stream, buf)
+	stream.Close()
+	if err != nil {
+		return 0, err
+	}
+	peak := 0
+	for i := 0; i+1 < len(buf); i += 2 {
+		v := int(int16(uint16(buf[i]) | uint16(buf[i+1])<<8))
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+	}
+	w, err := NewWriter(DefaultRecorder.rate, DefaultRecorder.channel, buf)
+	if err != nil {
+		return peak, err
+	}
+	defer w.Close()
+	return peak, w.Play()
+}
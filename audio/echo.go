@@ -0,0 +1,124 @@
+package audio
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// EchoCanceller 从录音中去掉扬声器播放的声音，aec.NLMS是一个实现
+type EchoCanceller interface {
+	// Process 用参考信号ref消除mic中的回声，结果写入out，三者的长度相同
+	Process(mic, ref, out []int16)
+}
+
+// maxReferenceDelay 是参考信号最多缓存的采样数(不包括设置的延迟)，录音跟不上播放的时候重新对齐
+const maxReferenceDelay = 16000
+
+// MaxEchoDelay 是SetEchoDelay支持的最大延迟
+const MaxEchoDelay = time.Second
+
+// refState 是一个Writer写入参考信号的状态，只在这个Writer的播放回调里面访问
+type refState struct {
+	// 上次写入的参考信号，为nil或者参考信号被替换的时候需要重新对齐
+	ref *reference
+	// 下一个采样在参考信号中的绝对位置
+	pos int64
+	// 重采样的相位，单位为输出采样
+	phase float64
+}
+
+// reference 保存播放出去的声音，转换成录音的采样率和单声道之后作为回声消除的参考信号。
+// 参考信号是一条和录音对齐的时间线，同时播放的多个Writer的声音在时间线上叠加，
+// 每个Writer开始播放的时候放在delay之后，补偿声音从播放回调到出现在录音中的延迟。
+// write在播放的实时回调中调用，所以时间线是预先分配的环形缓冲区，读写都只用原子操作，不加锁也不分配内存
+type reference struct {
+	// 64位的原子变量放在最前面，保证在32位的平台上对齐
+	// start 是已经被录音读取的采样数
+	start int64
+	delay int64
+
+	rate int
+	ring []int32
+}
+
+func newReference(rate int) *reference {
+	maxDelay := int64(MaxEchoDelay) * int64(rate) / int64(time.Second)
+	return &reference{
+		rate: rate,
+		ring: make([]int32, maxDelay+maxReferenceDelay),
+	}
+}
+
+// setDelay 设置播放到录音的延迟，在之后开始播放的声音上生效，超过MaxEchoDelay的时候使用MaxEchoDelay
+func (r *reference) setDelay(d time.Duration) {
+	if d > MaxEchoDelay {
+		d = MaxEchoDelay
+	}
+	atomic.StoreInt64(&r.delay, int64(d)*int64(r.rate)/int64(time.Second))
+}
+
+// write 在播放的回调中被调用，samples为rate采样率channel声道的交错数据，state为这个Writer的写入状态
+func (r *reference) write(state *refState, samples []int16, rate, channel int) {
+	step := float64(rate) / float64(r.rate)
+	frames := len(samples) / channel
+	size := int64(len(r.ring))
+	for ; state.phase < float64(frames); state.phase += step {
+		i := int(state.phase) * channel
+		var v int
+		for c := 0; c < channel; c++ {
+			v += int(samples[i+c])
+		}
+		start := atomic.LoadInt64(&r.start)
+		// 刚开始播放、暂停之后继续播放或者录音停止之后，回声在delay之后才会出现在录音中
+		if state.ref != r || state.pos < start || state.pos-start >= size {
+			state.ref = r
+			state.pos = start + atomic.LoadInt64(&r.delay)
+		}
+		atomic.AddInt32(&r.ring[state.pos%size], int32(v/channel))
+		state.pos++
+	}
+	state.phase -= float64(frames)
+}
+
+// read 取出和录音对齐的n个参考采样，没有播放的部分为静音
+func (r *reference) read(out []int16) {
+	start := atomic.LoadInt64(&r.start)
+	size := int64(len(r.ring))
+	for i := range out {
+		// 读取之后清空，环形缓冲区转一圈之后重新叠加
+		out[i] = clip16(atomic.SwapInt32(&r.ring[(start+int64(i))%size], 0))
+	}
+	atomic.AddInt64(&r.start, int64(len(out)))
+}
+
+func clip16(v int32) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// EstimateEchoDelay 根据播放和录音设备的默认延迟估计播放的声音出现在录音中的延迟
+func EstimateEchoDelay() (time.Duration, error) {
+	out, err := FindDevice(OutputDevice, false)
+	if err != nil {
+		return 0, err
+	}
+	in, err := FindDevice(InputDevice, true)
+	if err != nil {
+		return 0, err
+	}
+	return out.DefaultHighOutputLatency + in.DefaultLowInputLatency, nil
+}
+
+// playbackReference 不为nil的时候所有Writer播放的声音都会写入
+var playbackReference atomic.Value
+
+func loadReference() *reference {
+	ref, _ := playbackReference.Load().(*reference)
+	return ref
+}
@@ -0,0 +1,154 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/icexin/dueros/audio/aec"
+)
+
+func TestReferenceMix(t *testing.T) {
+	r := newReference(16000)
+	r.setDelay(time.Millisecond)
+	music, speech := new(refState), new(refState)
+	r.write(music, []int16{1000, 1000, 1000, 1000}, 16000, 1)
+	// 双声道的声音取平均值，和同时播放的music叠加
+	r.write(speech, []int16{32000, 32000, 2000, 0}, 16000, 2)
+
+	out := make([]int16, 24)
+	r.read(out)
+	want := make([]int16, 24)
+	// 1ms的延迟为16个采样
+	want[16], want[17], want[18], want[19] = math.MaxInt16, 2000, 1000, 1000
+	for i := range want {
+		if out[i] != want[i] {
+			t.Fatalf("expect %v, got %v", want, out)
+		}
+	}
+
+	// 停止播放之后重新开始，重新对齐到延迟之后
+	r.write(music, []int16{1}, 16000, 1)
+	r.read(out[:16])
+	r.read(out[:1])
+	if out[0] != 1 {
+		t.Errorf("expect restarted writer after delay, got %d", out[0])
+	}
+}
+
+// erle 返回回声衰减的分贝数
+func erle(mic, out []int16) float64 {
+	var em, eo float64
+	for i := range mic {
+		em += float64(mic[i]) * float64(mic[i])
+		eo += float64(out[i]) * float64(out[i])
+	}
+	return 10 * math.Log10(em/eo)
+}
+
+func TestDelayedEcho(t *testing.T) {
+	const (
+		rate = 16000
+		// 回声比播放回调晚125ms，超过滤波器能覆盖的长度
+		echoDelay = 2000
+		// 播放回调每次写入的采样数，录音每次读取的采样数
+		writeChunk = 512
+		readChunk  = 160
+	)
+	rnd := rand.New(rand.NewSource(1))
+	played := make([]int16, rate*4)
+	for i := range played {
+		played[i] = int16(rnd.NormFloat64() * 3000)
+	}
+	// 回声路径：延迟加衰减
+	mic := make([]int16, len(played))
+	for i := range mic {
+		if j := i - echoDelay; j >= 0 {
+			v := 0.5 * float64(played[j])
+			if j >= 30 {
+				v -= 0.2 * float64(played[j-30])
+			}
+			mic[i] = int16(v)
+		}
+	}
+
+	cases := []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{0, false},
+		{echoDelay * time.Second / rate, true},
+	}
+	for _, c := range cases {
+		r := newReference(rate)
+		r.setDelay(c.delay)
+		w := new(refState)
+		ec := aec.NewNLMS(256, aec.DefaultStep)
+		out := make([]int16, len(mic))
+		ref := make([]int16, readChunk)
+		written := 0
+		for i := 0; i < len(mic); i += readChunk {
+			// 播放回调在录音之前写入下一段
+			for written <= i && written < len(played) {
+				r.write(w, played[written:written+writeChunk], rate, 1)
+				written += writeChunk
+			}
+			r.read(ref)
+			ec.Process(mic[i:i+readChunk], ref, out[i:i+readChunk])
+		}
+		tail := len(mic) - rate
+		db := erle(mic[tail:], out[tail:])
+		if c.ok && db < 20 {
+			t.Errorf("delay %s: expect erle >= 20dB, got %.1fdB", c.delay, db)
+		}
+		if !c.ok && db > 3 {
+			t.Errorf("delay %s: expect no echo cancelled, got %.1fdB", c.delay, db)
+		}
+	}
+}
+
+func TestReferenceWrap(t *testing.T) {
+	r := newReference(16000)
+	w := new(refState)
+	out := make([]int16, 160)
+	samples := make([]int16, 160)
+	for i := range samples {
+		samples[i] = int16(i + 1)
+	}
+	// 多次绕过环形缓冲区之后仍然对齐，读取过的位置被清空
+	for n := 0; n < len(r.ring)/160*3; n++ {
+		r.write(w, samples, 16000, 1)
+		r.read(out)
+		for i := range out {
+			if out[i] != samples[i] {
+				t.Fatalf("round %d: expect %d at %d, got %d", n, samples[i], i, out[i])
+			}
+		}
+	}
+
+	// 录音停止的时候播放不会超过环形缓冲区，之后重新对齐到delay之后
+	r.setDelay(10 * time.Millisecond)
+	for n := 0; n < len(r.ring)/160+1; n++ {
+		r.write(w, samples, 16000, 1)
+	}
+	if d := w.pos - r.start; d < 0 || d >= int64(len(r.ring)) {
+		t.Errorf("expect writer within the ring, got %d ahead", d)
+	}
+}
+
+func TestReferenceWriteNoAlloc(t *testing.T) {
+	r := newReference(16000)
+	r.setDelay(100 * time.Millisecond)
+	w := new(refState)
+	samples := make([]int16, 1024)
+	out := make([]int16, 160)
+	// 播放回调中不能分配内存
+	allocs := testing.AllocsPerRun(100, func() {
+		r.write(w, samples, 48000, 2)
+		r.read(out)
+	})
+	if allocs != 0 {
+		t.Errorf("expect no allocation, got %v", allocs)
+	}
+}
@@ -3,14 +3,14 @@ package audio
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 
 	"github.com/bobertlo/go-mpg123/mpg123"
+	"github.com/icexin/dueros/logger"
 )
 
 type Player struct {
@@ -21,19 +21,66 @@ func NewPlayer() *Player {
 	return &Player{}
 }
 
+// LoadMP3Reader 边读取边解码r中的mp3数据，返回的Writer不用等待数据全部到达就可以开始播放，
+// r为io.Closer的时候会在读取结束后关闭
 func (p *Player) LoadMP3Reader(r io.Reader) (*Writer, error) {
-	tmpfile, err := ioutil.TempFile("", "dueros-mp3")
+	pr, pw, err := os.Pipe()
 	if err != nil {
+		closeReader(r)
 		return nil, err
 	}
-	defer os.Remove(tmpfile.Name())
-	defer tmpfile.Close()
-	n, err := io.Copy(tmpfile, r)
+	go func() {
+		n, err := io.Copy(pw, r)
+		if err != nil {
+			logger.Errorf("read mp3 stream error:%s", err)
+		}
+		logger.Debugf("read %d bytes of mp3 stream", n)
+		pw.Close()
+		closeReader(r)
+	}()
+
+	d, err := mpg123.NewDecoder("")
 	if err != nil {
+		pr.Close()
 		return nil, err
 	}
-	log.Printf("save %d bytes to %s", n, tmpfile.Name())
-	return p.loadMP3File(tmpfile.Name())
+	err = d.OpenFile(pr)
+	if err != nil {
+		d.Delete()
+		pr.Close()
+		return nil, err
+	}
+	// 解析第一帧的时候会阻塞到数据到达
+	rate, channels, encoding := d.GetFormat()
+	logger.Debugf("rate:%d, channel:%d, encoding:%d", rate, channels, encoding)
+	if rate == 0 {
+		d.Close()
+		d.Delete()
+		pr.Close()
+		return nil, errors.New("bad mp3 stream")
+	}
+
+	w, err := NewStreamWriter(int(rate), channels)
+	if err != nil {
+		d.Close()
+		d.Delete()
+		pr.Close()
+		return nil, err
+	}
+	go func() {
+		io.Copy(w, d)
+		w.CloseWrite()
+		d.Close()
+		d.Delete()
+		pr.Close()
+	}()
+	return w, nil
+}
+
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
 }
 
 func (p *Player) LoadMP3(uri string) (*Writer, error) {
@@ -47,7 +94,11 @@ func (p *Player) LoadMP3(uri string) (*Writer, error) {
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
+		// 错误页面不是mp3，不能交给解码器
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("get %s: %s", uri, resp.Status)
+		}
 		return p.LoadMP3Reader(resp.Body)
 	case "", "file":
 		return p.loadMP3File(u.Path)
@@ -75,7 +126,7 @@ func (p *Player) loadMP3File(file string) (*Writer, error) {
 		return nil, err
 	}
 	rate, channels, encoding := d.GetFormat()
-	log.Printf("rate:%d, channel:%d, encoding:%d", rate, channels, encoding)
+	logger.Debugf("rate:%d, channel:%d, encoding:%d", rate, channels, encoding)
 
 	buf := new(bytes.Buffer)
 	io.Copy(buf, d)
@@ -0,0 +1,19 @@
+package audio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoadMP3BadStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>forbidden</html>", http.StatusForbidden)
+	}))
+	defer server.Close()
+	_, err := NewPlayer().LoadMP3(server.URL + "/song.mp3")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expect 403 error, got %v", err)
+	}
+}
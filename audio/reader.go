@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/gordonklaus/portaudio"
 	"github.com/pkg/errors"
@@ -14,7 +15,9 @@ var (
 )
 
 var (
+	// DefaultRecorder 由OpenDefaultRecorder打开
 	DefaultRecorder *Recorder
+	openMutex       sync.Mutex
 )
 
 type Reader struct {
@@ -26,7 +29,15 @@ func NewReader(rate, channel, frames int) (*Reader, error) {
 	r := &Reader{
 		data: make([]int16, frames),
 	}
-	stream, err := portaudio.OpenDefaultStream(channel, 0, float64(rate), len(r.data), r.data)
+	device, err := FindDevice(InputDevice, true)
+	if err != nil {
+		return nil, err
+	}
+	param := portaudio.LowLatencyParameters(device, nil)
+	param.Input.Channels = channel
+	param.SampleRate = float64(rate)
+	param.FramesPerBuffer = len(r.data)
+	stream, err := portaudio.OpenStream(param, r.data)
 	if err != nil {
 		return nil, fmt.Errorf("Error open default audio stream: %s", err)
 	}
@@ -62,8 +73,20 @@ func init() {
 	if err != nil {
 		log.Fatalf("Error initialize audio interface: %s", err)
 	}
-	DefaultRecorder, err = NewRecorder(16000, 1)
+}
+
+// OpenDefaultRecorder 使用InputDevice打开DefaultRecorder，已经打开的时候直接返回，
+// 需要在设置好InputDevice之后、使用DefaultRecorder之前调用
+func OpenDefaultRecorder() error {
+	openMutex.Lock()
+	defer openMutex.Unlock()
+	if DefaultRecorder != nil {
+		return nil
+	}
+	r, err := NewRecorder(16000, 1)
 	if err != nil {
-		log.Fatalf("Error initialize default recorder: %s", err)
+		return fmt.Errorf("Error initialize default recorder: %s", err)
 	}
+	DefaultRecorder = r
+	return nil
 }
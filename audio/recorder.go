@@ -1,57 +1,83 @@
 package audio
 
 import (
+	"encoding/binary"
 	"io"
 	"sync"
+	"time"
+
+	"github.com/icexin/dueros/logger"
 )
 
-type streamReader struct {
+// ringDuration 是录音缓冲区保存的时长，决定了NewStreamAt最早可以从多久之前开始
+const ringDuration = 5 * time.Second
+
+// Position 是从开始录音到某个时刻的字节数，用于标记录音中的某个时刻
+type Position int64
+
+// Stream 是从某个位置开始的录音流
+type Stream struct {
 	r      *Recorder
+	pos    Position
 	closed bool
+	// Stop之后的结束位置，读到这里之后返回io.EOF
+	stopped bool
+	end     Position
 }
 
-func newStreamReader(r *Recorder) *streamReader {
-	return &streamReader{
-		r: r,
-	}
+// Read 阻塞直到读满b，b的长度需要是采样大小的整数倍，
+// b超过缓冲区的一半的时候只读取一半缓冲区大小的数据，需要读取更长的录音时使用io.ReadFull
+func (s *Stream) Read(b []byte) (int, error) {
+	return s.r.read(s, b)
 }
 
-func (s *streamReader) Read(b []byte) (int, error) {
-	if s.closed {
-		return 0, io.EOF
-	}
+// Position 返回已经读取到的位置
+func (s *Stream) Position() Position {
+	s.r.bufMutex.Lock()
+	defer s.r.bufMutex.Unlock()
+	return s.pos
+}
 
-	buf := b
-	for {
-		n, err := s.r.read(buf)
-		if err == ErrShortBuffer {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
-		buf = buf[n:]
-	}
-	n := len(b) - len(buf)
-	if n == 0 {
-		return 0, ErrShortBuffer
+// Stop 在当前录音的位置结束录音流，之前的数据仍然可以读取
+func (s *Stream) Stop() {
+	s.r.bufMutex.Lock()
+	defer s.r.bufMutex.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		s.end = s.r.pos
+		s.r.cond.Broadcast()
 	}
-	return n, nil
 }
 
-func (s *streamReader) Close() error {
-	if s.closed {
-		return nil
-	}
-	s.closed = true
-	s.r.onStreamClosed()
-	return nil
+// Ended 在录音流被关闭或者停止之后返回true
+func (s *Stream) Ended() bool {
+	s.r.bufMutex.Lock()
+	defer s.r.bufMutex.Unlock()
+	return s.closed || s.stopped
 }
 
+func (s *Stream) Close() error {
+	return s.r.closeStream(s)
+}
+
+// Recorder 持续录音到一个环形缓冲区里面，录音流可以从缓冲区中的任意位置开始读取，
+// 同一时刻可以有多个录音流，例如一直运行的唤醒词检测和按需打开的语音识别
 type Recorder struct {
 	r *Reader
 
-	mutex sync.Mutex
+	rate    int
+	channel int
+
+	ecMutex sync.Mutex
+	ec      EchoCanceller
+	ecDelay time.Duration
+	ref     *reference
+
+	bufMutex sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	// 已经录制的总字节数
+	pos Position
 }
 
 func NewRecorder(rate, channel int) (*Recorder, error) {
@@ -60,24 +86,188 @@ func NewRecorder(rate, channel int) (*Recorder, error) {
 		return nil, err
 	}
 
-	return &Recorder{
-		r: r,
-	}, nil
+	recorder := &Recorder{
+		r:       r,
+		rate:    rate,
+		channel: channel,
+		buf:     make([]byte, durationBytes(rate, channel, ringDuration)),
+	}
+	recorder.cond = sync.NewCond(&recorder.bufMutex)
+	go recorder.capture()
+	return recorder, nil
+}
+
+// durationBytes 返回d时长的录音的字节数
+func durationBytes(rate, channel int, d time.Duration) int64 {
+	frames := int64(rate) * int64(d) / int64(time.Second)
+	return frames * int64(channel) * 2
+}
+
+// SetEchoCanceller 在录音到达唤醒检测和语音识别之前用ec消除扬声器播放的声音，
+// ec为nil的时候关闭回声消除，只支持单声道的录音
+func (r *Recorder) SetEchoCanceller(ec EchoCanceller) {
+	r.ecMutex.Lock()
+	defer r.ecMutex.Unlock()
+	r.ec = ec
+	if ec == nil {
+		r.ref = nil
+	} else if r.ref == nil {
+		r.ref = newReference(r.rate)
+		r.ref.setDelay(r.ecDelay)
+	}
+	playbackReference.Store(r.ref)
+}
+
+// SetEchoDelay 设置播放的声音从播放回调到出现在录音中的延迟，参考信号延迟d之后再用于回声消除。
+// 延迟超过回声消除滤波器的长度的时候不设置延迟会消除不了回声，可以用EstimateEchoDelay估计
+func (r *Recorder) SetEchoDelay(d time.Duration) {
+	r.ecMutex.Lock()
+	defer r.ecMutex.Unlock()
+	r.ecDelay = d
+	if r.ref != nil {
+		r.ref.setDelay(d)
+	}
+}
+
+// cancelEcho 对buf中的录音做回声消除
+func (r *Recorder) cancelEcho(buf []byte, mic, ref []int16) {
+	r.ecMutex.Lock()
+	defer r.ecMutex.Unlock()
+	if r.ec == nil || r.channel != 1 {
+		return
+	}
+	for i := range mic {
+		mic[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+	}
+	r.ref.read(ref)
+	r.ec.Process(mic, ref, mic)
+	for i := range mic {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(mic[i]))
+	}
+}
+
+func (r *Recorder) capture() {
+	buf := make([]byte, len(r.r.data)*2)
+	mic := make([]int16, len(r.r.data))
+	ref := make([]int16, len(r.r.data))
+	for {
+		n, err := r.r.Read(buf)
+		if err != nil {
+			logger.Errorf("record error:%s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		r.cancelEcho(buf[:n], mic[:n/2], ref[:n/2])
+		r.write(buf[:n])
+	}
+}
+
+// write 把录音写入环形缓冲区，唤醒等待数据的录音流
+func (r *Recorder) write(b []byte) {
+	r.bufMutex.Lock()
+	defer r.bufMutex.Unlock()
+	off := int(r.pos % Position(len(r.buf)))
+	m := copy(r.buf[off:], b)
+	copy(r.buf, b[m:])
+	r.pos += Position(len(b))
+	r.cond.Broadcast()
+}
+
+// Position 返回当前录音的位置
+func (r *Recorder) Position() Position {
+	r.bufMutex.Lock()
+	defer r.bufMutex.Unlock()
+	return r.pos
+}
+
+// Before 返回p之前d时长的位置
+func (r *Recorder) Before(p Position, d time.Duration) Position {
+	p -= Position(durationBytes(r.rate, r.channel, d))
+	if p < 0 {
+		p = 0
+	}
+	return p
+}
+
+// NewStreamAt 返回从p开始的录音流，p早于缓冲区中最早的数据的时候从最早的数据开始
+func (r *Recorder) NewStreamAt(p Position) *Stream {
+	r.bufMutex.Lock()
+	defer r.bufMutex.Unlock()
+	if oldest := r.pos - Position(len(r.buf)); p < oldest {
+		p = oldest
+	}
+	if p > r.pos {
+		p = r.pos
+	}
+	return &Stream{
+		r:   r,
+		pos: p,
+	}
 }
 
+// NewStream 返回从当前时刻开始的录音流
 func (r *Recorder) NewStream() io.ReadCloser {
-	r.mutex.Lock()
-	return newStreamReader(r)
+	return r.NewStreamAt(r.Position())
 }
 
-func (r *Recorder) read(b []byte) (int, error) {
-	return r.r.Read(b)
+func (r *Recorder) read(s *Stream, b []byte) (int, error) {
+	frame := 2 * r.channel
+	n := len(b) / frame * frame
+	// 超过缓冲区大小的数据永远等不到，留出一半的缓冲区避免读取的时候被覆盖
+	if max := len(r.buf) / 2 / frame * frame; n > max {
+		n = max
+	}
+	if n == 0 {
+		return 0, ErrShortBuffer
+	}
+	r.bufMutex.Lock()
+	defer r.bufMutex.Unlock()
+	for {
+		if s.closed {
+			return 0, io.EOF
+		}
+		// 读取的太慢，最早的数据已经被覆盖
+		if oldest := r.pos - Position(len(r.buf)); s.pos < oldest {
+			logger.Warnf("record stream overrun, skip %d bytes", oldest-s.pos)
+			s.pos = oldest
+		}
+		if s.stopped {
+			if s.pos >= s.end {
+				return 0, io.EOF
+			}
+			if left := int(s.end - s.pos); left < n {
+				n = left
+			}
+		}
+		if r.pos-s.pos >= Position(n) {
+			break
+		}
+		r.cond.Wait()
+	}
+	off := int(s.pos % Position(len(r.buf)))
+	m := copy(b[:n], r.buf[off:])
+	copy(b[m:n], r.buf)
+	s.pos += Position(n)
+	return n, nil
 }
 
-func (r *Recorder) onStreamClosed() {
-	r.mutex.Unlock()
+func (r *Recorder) closeStream(s *Stream) error {
+	r.bufMutex.Lock()
+	if s.closed {
+		r.bufMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	r.cond.Broadcast()
+	r.bufMutex.Unlock()
+	return nil
 }
 
 func NewRecordStream() io.ReadCloser {
 	return DefaultRecorder.NewStream()
 }
+
+// NewRecordStreamAt 返回DefaultRecorder从p开始的录音流
+func NewRecordStreamAt(p Position) *Stream {
+	return DefaultRecorder.NewStreamAt(p)
+}
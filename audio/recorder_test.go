@@ -0,0 +1,71 @@
+package audio
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRecorder 创建不依赖录音设备的Recorder，录音通过write写入
+func newTestRecorder(d time.Duration) *Recorder {
+	r := &Recorder{
+		rate:    16000,
+		channel: 1,
+		buf:     make([]byte, durationBytes(16000, 1, d)),
+	}
+	r.cond = sync.NewCond(&r.bufMutex)
+	return r
+}
+
+func TestReadLongerThanRing(t *testing.T) {
+	r := newTestRecorder(100 * time.Millisecond)
+	stream := r.NewStreamAt(r.Position())
+	defer stream.Close()
+
+	// 读取缓冲区3倍长度的录音，分多次写入
+	want := make([]byte, len(r.buf)*3)
+	for i := range want {
+		want[i] = byte(i / 2)
+	}
+	go func() {
+		for b := want; len(b) > 0; b = b[320:] {
+			r.write(b[:320])
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	got := make([]byte, len(want))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(stream, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read longer than ring buffer never returns")
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("data mismatch at %d", i)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	r := newTestRecorder(100 * time.Millisecond)
+	stream := r.NewStreamAt(r.Position())
+	defer stream.Close()
+	r.write(make([]byte, len(r.buf)))
+	n, err := stream.Read(make([]byte, len(r.buf)*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(r.buf)/2 {
+		t.Errorf("expect read %d bytes, got %d", len(r.buf)/2, n)
+	}
+}
@@ -1,34 +1,37 @@
 package audio
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
-	"os"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gordonklaus/portaudio"
+	"github.com/icexin/dueros/metrics"
 )
 
-func getOutDeviceByName(name string) *portaudio.DeviceInfo {
-	devices, err := portaudio.Devices()
-	if err != nil {
-		log.Print(err)
-		return nil
+var playbackUnderruns = metrics.NewCounter("dueros_playback_underruns_total", "playback callbacks filled with silence because data had not arrived")
+
+// gain 是所有Writer播放的音量，保存float64的位
+var gain = math.Float64bits(1)
+
+// SetGain 设置所有Writer播放的音量，范围为[0, 1]，0为静音，1为原始音量
+func SetGain(g float64) {
+	if g < 0 {
+		g = 0
 	}
-	for _, device := range devices {
-		if device.MaxOutputChannels == 0 {
-			continue
-		}
-		if device.Name == name {
-			return device
-		}
+	if g > 1 {
+		g = 1
 	}
-	return nil
+	atomic.StoreUint64(&gain, math.Float64bits(g))
+}
+
+// Gain 返回SetGain设置的音量
+func Gain() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&gain))
 }
 
 type Writer struct {
@@ -36,42 +39,45 @@ type Writer struct {
 
 	rate, channel int
 
-	buf []int16
-	pos int32
-
-	mutex sync.Mutex
-	cond  *sync.Cond
-	done  bool
-
+	// buf由bufMutex保护，流式写入的时候会不断增长
+	bufMutex sync.Mutex
+	buf      []int16
+	pos      int32
+	eof      bool
+	// 回声消除参考信号的写入状态，只在播放回调里面访问
+	ref refState
+
+	// mutex保护下面的播放状态，Close可能和Write、Pause在不同的goroutine里面调用
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	done   bool
 	paused bool
 	closed bool
 }
 
+// NewWriter 创建一个播放buffer中pcm数据的Writer
 func NewWriter(rate, channel int, buffer []byte) (*Writer, error) {
+	w, err := NewStreamWriter(rate, channel)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(buffer)
+	w.CloseWrite()
+	return w, nil
+}
+
+// NewStreamWriter 创建一个边写入边播放的Writer，
+// pcm数据通过Write写入，CloseWrite之后播放完剩余的数据即结束
+func NewStreamWriter(rate, channel int) (*Writer, error) {
 	w := &Writer{
 		rate:    rate,
 		channel: channel,
-		buf:     make([]int16, len(buffer)/2),
 	}
 	w.cond = sync.NewCond(&w.mutex)
 
-	var device *portaudio.DeviceInfo
-	var err error
-	err = binary.Read(bytes.NewBuffer(buffer), binary.LittleEndian, w.buf)
+	device, err := FindDevice(OutputDevice, false)
 	if err != nil {
-		panic(err)
-	}
-	name := os.Getenv("DUEROS_OUT")
-	if name != "" {
-		device = getOutDeviceByName(name)
-		if device == nil {
-			return nil, errors.New("bad out device name")
-		}
-	} else {
-		device, err = portaudio.DefaultOutputDevice()
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 	param := portaudio.HighLatencyParameters(nil, device)
 	param.SampleRate = float64(rate)
@@ -86,16 +92,58 @@ func NewWriter(rate, channel int, buffer []byte) (*Writer, error) {
 	return w, nil
 }
 
+// Write 追加little endian的16位pcm数据
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.Closed() {
+		return 0, errors.New("closed")
+	}
+	samples := make([]int16, len(p)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(p[i*2:]))
+	}
+	w.bufMutex.Lock()
+	w.buf = append(w.buf, samples...)
+	w.bufMutex.Unlock()
+	return len(samples) * 2, nil
+}
+
+// CloseWrite 表示所有数据已经写入
+func (w *Writer) CloseWrite() {
+	w.bufMutex.Lock()
+	w.eof = true
+	finished := int(w.pos) == len(w.buf)
+	w.bufMutex.Unlock()
+	if finished {
+		w.playDone()
+	}
+}
+
 func (w *Writer) callback(out []int16) {
-	if int(w.pos) == len(w.buf) {
+	w.bufMutex.Lock()
+	defer w.bufMutex.Unlock()
+	pos := int(w.pos)
+	if pos == len(w.buf) && w.eof {
 		return
 	}
-	var i = 0
-	for i = 0; i < len(out) && i+int(w.pos) < len(w.buf); i++ {
-		out[i] = w.buf[int(w.pos)+i]
+	// 数据还没有到达的部分用静音填充
+	n := copy(out, w.buf[pos:])
+	for i := n; i < len(out); i++ {
+		out[i] = 0
+	}
+	if n < len(out) && !w.eof {
+		playbackUnderruns.Inc()
 	}
-	atomic.AddInt32(&w.pos, int32(i))
-	if int(w.pos) == len(w.buf) {
+	if g := Gain(); g != 1 {
+		for i := range out[:n] {
+			out[i] = int16(float64(out[i]) * g)
+		}
+	}
+	atomic.AddInt32(&w.pos, int32(n))
+	// 播放的声音作为回声消除的参考信号
+	if ref := loadReference(); ref != nil {
+		ref.write(&w.ref, out, w.rate, w.channel)
+	}
+	if pos+n == len(w.buf) && w.eof {
 		go w.playDone()
 	}
 }
@@ -108,15 +156,19 @@ func (w *Writer) playDone() {
 }
 
 func (w *Writer) Len() time.Duration {
+	w.bufMutex.Lock()
 	frames := len(w.buf) / w.channel
+	w.bufMutex.Unlock()
 	return time.Duration(frames*1000/w.rate) * time.Millisecond
 }
 
 func (w *Writer) SetOffset(offset time.Duration) {
-	if w.closed {
+	if w.Closed() {
 		return
 	}
 	length := w.Len()
+	w.bufMutex.Lock()
+	defer w.bufMutex.Unlock()
 	n := int32(offset/length) * int32(len(w.buf))
 	if n < int32(len(w.buf)) {
 		atomic.StoreInt32(&w.pos, n)
@@ -138,6 +190,8 @@ func (w *Writer) Play() error {
 }
 
 func (w *Writer) Start() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	if w.closed {
 		return errors.New("closed")
 	}
@@ -157,7 +211,9 @@ func (w *Writer) Wait() {
 }
 
 func (w *Writer) Pause() {
-	if w.paused {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.paused || w.closed {
 		return
 	}
 	w.paused = true
@@ -165,6 +221,8 @@ func (w *Writer) Pause() {
 }
 
 func (w *Writer) Resume() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	if !w.paused || w.closed {
 		return
 	}
@@ -173,14 +231,20 @@ func (w *Writer) Resume() {
 }
 
 func (w *Writer) Closed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	return w.closed
 }
 
 func (w *Writer) Close() error {
+	w.mutex.Lock()
 	if w.closed {
+		w.mutex.Unlock()
 		return nil
 	}
 	w.closed = true
-	w.playDone()
+	w.done = true
+	w.mutex.Unlock()
+	w.cond.Broadcast()
 	return w.stream.Close()
 }
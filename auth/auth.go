@@ -6,27 +6,29 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/metrics"
 )
 
+var tokenRefreshes = metrics.NewCounter("dueros_token_refreshes_total", "refreshes of the access token", "result")
+
 var (
 	// 百度token服务器url
 	tokenUrl = "https://openapi.baidu.com/oauth/2.0/token"
 	// 百度oauth服务器url
 	oauthUrl = "https://openapi.baidu.com/oauth/2.0/authorize"
-
-	redirectUri = "http://pi.local:8080/authresponse"
-
-	tokenFile = "token.json"
 )
 
 var (
 	clientID     = flag.String("client_id", "", "client id of oauth")
 	clientSecret = flag.String("client_secret", "", "client secret of oauth")
 	accessToken  = flag.String("access_token", "", "access token of oauth, if not empty, client_id and client_secret can leave empty")
+	tokenFile    = flag.String("token_file", "token.json", "file to save oauth token")
+	redirectUri  = flag.String("redirect_uri", "http://pi.local:8080/authresponse", "redirect uri of oauth, must be the same as the one of the baidu app")
 )
 
 type token struct {
@@ -59,7 +61,7 @@ func (t *token) Refresh() error {
 }
 
 func loadToken(f string) (*token, error) {
-	buf, err := ioutil.ReadFile(tokenFile)
+	buf, err := ioutil.ReadFile(f)
 	if err != nil {
 		return nil, err
 	}
@@ -75,21 +77,40 @@ func GetToken() (string, error) {
 	if *accessToken != "" {
 		return *accessToken, nil
 	}
-	t, err := loadToken(tokenFile)
+	t, err := loadToken(*tokenFile)
 	if err != nil {
 		return "", err
 	}
 	if time.Now().After(t.Expiry) {
-		log.Print("token expire, refresh")
-		err = t.Refresh()
-		if err != nil {
-			return "", err
-		}
-		err = t.Save(tokenFile)
-		if err != nil {
-			return "", err
-		}
-		return t.AccessToken, nil
+		logger.Infof("token expire, refresh")
+		return refresh(t)
+	}
+	return t.AccessToken, nil
+}
+
+// RefreshToken 在token过期之前强制刷新，例如服务端返回401的时候，
+// 通过--access_token指定的token不能刷新
+func RefreshToken() (string, error) {
+	if *accessToken != "" {
+		return "", errors.New("can't refresh access_token from flag")
+	}
+	t, err := loadToken(*tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return refresh(t)
+}
+
+func refresh(t *token) (string, error) {
+	err := t.Refresh()
+	if err != nil {
+		tokenRefreshes.Inc("error")
+		return "", err
+	}
+	tokenRefreshes.Inc("ok")
+	err = t.Save(*tokenFile)
+	if err != nil {
+		return "", err
 	}
 	return t.AccessToken, nil
 }
@@ -122,12 +143,12 @@ func login(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "token ok")
 		return
 	}
-	log.Print(err)
+	logger.Infof("no token, redirect to oauth:%s", err)
 	values := url.Values{}
 	values.Set("client_id", *clientID)
 	values.Set("scope", "basic")
 	values.Set("response_type", "code")
-	values.Set("redirect_uri", redirectUri)
+	values.Set("redirect_uri", *redirectUri)
 	uri := fmt.Sprintf("%s?%s", oauthUrl, values.Encode())
 	http.Redirect(w, r, uri, 302)
 }
@@ -140,7 +161,7 @@ func authResponse(w http.ResponseWriter, r *http.Request) {
 	values.Set("code", code)
 	values.Set("client_id", *clientID)
 	values.Set("client_secret", *clientSecret)
-	values.Set("redirect_uri", redirectUri)
+	values.Set("redirect_uri", *redirectUri)
 	uri := fmt.Sprintf("%s?%s", tokenUrl, values.Encode())
 	v, err := httpjson(uri)
 	if err != nil {
@@ -151,7 +172,7 @@ func authResponse(w http.ResponseWriter, r *http.Request) {
 	t.AccessToken = v["access_token"].(string)
 	t.RefreshToken = v["refresh_token"].(string)
 	t.Expiry = time.Now().Add(time.Duration(int(v["expires_in"].(float64))) * time.Second)
-	err = t.Save(tokenFile)
+	err = t.Save(*tokenFile)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -159,6 +180,31 @@ func authResponse(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "token ok")
 }
 
+// LoginURL 返回登录的地址，和redirect_uri在同一个服务上
+func LoginURL() string {
+	u, err := url.Parse(*redirectUri)
+	if err != nil {
+		return "/login"
+	}
+	u.Path = "/login"
+	u.RawQuery = ""
+	return u.String()
+}
+
+// Validate 检查oauth的配置，需要access_token或者client_id和client_secret
+func Validate() error {
+	if *accessToken != "" {
+		return nil
+	}
+	if *clientID == "" || *clientSecret == "" {
+		return errors.New("access_token or client_id and client_secret is required")
+	}
+	if _, err := url.Parse(*redirectUri); err != nil {
+		return fmt.Errorf("bad redirect_uri: %s", err)
+	}
+	return nil
+}
+
 func init() {
 	http.HandleFunc("/login", login)
 	http.HandleFunc("/authresponse", authResponse)
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/audio/aec"
+	"github.com/icexin/dueros/auth"
+	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/iface"
+	"github.com/icexin/dueros/metrics"
+	"github.com/icexin/dueros/proto"
+)
+
+var wakeupDetections = metrics.NewCounter("dueros_wakeup_detections_total", "wakeups of each method", "method")
+
+var wakeupPlayer = audio.NewPlayer()
+
+// command 是一个子命令，args是子命令之后的参数
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"run":     {"run", "wait for wakeup and talk to dueros, the default command", runCommand},
+	"login":   {"login", "authorize in the browser and save the token", loginCommand},
+	"devices": {"devices [-in device] [-out device] [-tone] [-loopback 3s]", "list audio devices and check them", devicesCommand},
+	"say":     {"say text", "send a text query and play the response", sayCommand},
+	"play":    {"play [-rate 16000] [-channel 1] file", "play a mp3 file, or raw pcm when the file ends with .pcm", playCommand},
+	"record":  {"record [-d duration] file", "record raw pcm from the input device, until enter is pressed or duration passed", recordCommand},
+	"replay":  {"replay session-dir", "replay a recorded session", replayCommand},
+	"status":  {"status", "show token, devices, queued events and the state of the running dueros", statusCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [args]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(out, "  %s\n    \t%s\n", c.usage, c.help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommand 从命令行参数中找出子命令和子命令的参数，没有指定子命令的时候为run
+func parseCommand(args []string) (string, *command, []string, error) {
+	name := "run"
+	if len(args) > 0 {
+		name = args[0]
+		args = args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return name, nil, nil, fmt.Errorf("unknown command %q", name)
+	}
+	if len(args) == 0 {
+		args = nil
+	}
+	return name, cmd, args, nil
+}
+
+func runCommand(args []string) error {
+	err := validateConfig()
+	if err != nil {
+		return fmt.Errorf("bad config: %s", err)
+	}
+	err = audio.OpenDefaultRecorder()
+	if err != nil {
+		return fmt.Errorf("open input device: %s", err)
+	}
+	voiceInput, err := iface.DefaultRegistry.VoiceInput()
+	if err != nil {
+		return err
+	}
+	if alerts, err := iface.DefaultRegistry.Alerts(); err == nil {
+		alerts.Sound = *alertSound
+		// 闹钟保存在事件队列的目录中，文件名不是.json结尾，不会被当成事件
+		if *eventQueueDir != "" {
+			alerts.File = filepath.Join(*eventQueueDir, "alerts.state")
+		}
+		err = alerts.Load()
+		if err != nil {
+			return err
+		}
+	}
+	setuphttp()
+	// 等待access token被设置好
+	waitToken()
+
+	iface.DefaultRegistry.Use(
+		iface.RecoveryInterceptor,
+		iface.LoggingInterceptor,
+		iface.DialogFilter(voiceInput.DialogRequestId),
+	)
+	iface.DefaultRegistry.UseContext(iface.RecoveryContextInterceptor)
+
+	opt := duerOptions()
+	if *recordDir != "" {
+		recorder, err := duer.NewRecorder(*recordDir)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		opt.Recorder = recorder
+		fmt.Printf(">>> 记录到 %s\n", recorder.Dir())
+	}
+	duer.OS, err = duer.NewDuerOS(iface.DefaultRegistry, opt)
+	if err != nil {
+		return err
+	}
+	// 运行时注册或者注销服务之后重新上报设备能力
+	iface.DefaultRegistry.OnChange(duer.OS.SynchronizeState)
+	setupapi()
+	if *echoCancel {
+		delay := *echoDelay
+		if delay == 0 {
+			delay, err = audio.EstimateEchoDelay()
+			if err != nil {
+				return err
+			}
+			fmt.Printf(">>> 估计的回声延迟 %s\n", delay)
+		}
+		audio.DefaultRecorder.SetEchoDelay(delay)
+		audio.DefaultRecorder.SetEchoCanceller(aec.NewNLMS(aec.DefaultTaps, aec.DefaultStep))
+	}
+	wakeup, err := NewWakeupListener(*wakeupMethod)
+	if err != nil {
+		return err
+	}
+	for {
+		fmt.Println(">>> 等待唤醒")
+		w, err := wakeup.ListenAndWakeup()
+		if err != nil {
+			return err
+		}
+		err = listen(w)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// listen 在唤醒之后打断播报，播放唤醒音并开始倾听
+func listen(w Wakeup) error {
+	voiceInput, err := iface.DefaultRegistry.VoiceInput()
+	if err != nil {
+		return err
+	}
+	voiceOutput, err := iface.DefaultRegistry.VoiceOutput()
+	if err != nil {
+		return err
+	}
+	wakeupDetections.Inc(w.Method)
+	// 播报的时候被唤醒则打断播报，音乐在倾听的时候会被暂停
+	voiceOutput.Interrupt()
+	wakeupPlayer.LoadAndPlay(*wakeupSound)
+	// 从唤醒的时刻开始上传录音，唤醒词之后紧接着说的话不会丢失
+	return voiceInput.ListenWith(iface.ListenOptions{
+		Position: audio.DefaultRecorder.Before(w.Position, *preroll),
+		Profile:  w.Profile,
+		Release:  w.Release,
+	})
+}
+
+func loginCommand(args []string) error {
+	err := auth.Validate()
+	if err != nil {
+		return err
+	}
+	if _, err := auth.GetToken(); err == nil {
+		fmt.Println(">>> 已经授权")
+		return nil
+	}
+	setuphttp()
+	waitToken()
+	fmt.Println(">>> 授权成功")
+	return nil
+}
+
+func sayCommand(args []string) error {
+	text := strings.TrimSpace(strings.Join(args, " "))
+	if text == "" {
+		return errors.New("missing text")
+	}
+	if _, err := auth.GetToken(); err != nil {
+		return fmt.Errorf("no token, run login first: %s", err)
+	}
+	// 响应中可能有ExpectSpeech指令，需要录音
+	err := audio.OpenDefaultRecorder()
+	if err != nil {
+		return fmt.Errorf("open input device: %s", err)
+	}
+	opt := duerOptions()
+	// 不发送run留下的未发送事件
+	opt.QueueDir = ""
+	duer.OS, err = duer.NewDuerOS(iface.DefaultRegistry, opt)
+	if err != nil {
+		return err
+	}
+	return duer.OS.Send(proto.NewMessage(proto.NamespaceTextInput+".TextInput", &proto.TextInputPayload{
+		Query: text,
+	}))
+}
+
+func playCommand(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ContinueOnError)
+	rate := fs.Int("rate", 16000, "sample rate of pcm file")
+	channel := fs.Int("channel", 1, "channels of pcm file")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("missing file")
+	}
+	file := fs.Arg(0)
+	if !strings.HasSuffix(file, ".pcm") {
+		return audio.NewPlayer().LoadAndPlay(file)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	w, err := audio.NewWriter(*rate, *channel, buf)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return w.Play()
+}
+
+func recordCommand(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	d := fs.Duration("d", 0, "stop recording after this long, 0 to stop on enter")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *d < 0 {
+		return fmt.Errorf("bad duration %s", *d)
+	}
+	if fs.NArg() != 1 {
+		return errors.New("missing file")
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = audio.OpenDefaultRecorder()
+	if err != nil {
+		return err
+	}
+	stream := audio.NewRecordStreamAt(audio.DefaultRecorder.Position())
+	defer stream.Close()
+	fmt.Println(">>> 开始录制, 16000Hz单声道16位pcm")
+	if *d > 0 {
+		time.AfterFunc(*d, stream.Stop)
+	} else {
+		fmt.Println(">>> 按回车后结束录制")
+		go func() {
+			fmt.Scanln()
+			stream.Stop()
+		}()
+	}
+	_, err = io.Copy(f, stream)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(">>> 录制结束, %s saved\n", fs.Arg(0))
+	return nil
+}
+
+func replayCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing session dir")
+	}
+	var err error
+	duer.OS, err = duer.NewReplayOS(iface.DefaultRegistry, *replayServer)
+	if err != nil {
+		return err
+	}
+	if *replayServer == "" {
+		return duer.OS.ReplayDirectives(args[0], *replayRealtime)
+	}
+	return duer.OS.ReplayEvents(args[0], *replayRealtime)
+}
+
+func statusCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("status takes no arguments")
+	}
+	return printStatus(os.Stdout)
+}
+
+// printStatus 输出本地的状态，如果有dueros正在运行，通过--http_addr上的接口获取运行状态
+func printStatus(out io.Writer) error {
+	if _, err := auth.GetToken(); err != nil {
+		fmt.Fprintf(out, "%-9s%s\n", "token:", err)
+	} else {
+		fmt.Fprintf(out, "%-9s%s\n", "token:", "ok")
+	}
+
+	showDevice := func(name, spec string, input bool) {
+		d, err := audio.FindDevice(spec, input)
+		if err != nil {
+			fmt.Fprintf(out, "%-9s%s\n", name+":", err)
+			return
+		}
+		fmt.Fprintf(out, "%-9s%s\n", name+":", d.Name)
+	}
+	showDevice("input", *audioIn, true)
+	showDevice("output", *audioOut, false)
+
+	if *eventQueueDir != "" {
+		n, err := duer.PendingEvents(*eventQueueDir)
+		if err != nil {
+			fmt.Fprintf(out, "%-9s%s\n", "events:", err)
+		} else {
+			fmt.Fprintf(out, "%-9s%d queued in %s\n", "events:", n, filepath.Clean(*eventQueueDir))
+		}
+	}
+
+	// 通过http接口判断是否有dueros正在运行
+	host, port, err := net.SplitHostPort(*httpAddr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/api/status")
+	if err != nil {
+		fmt.Fprintf(out, "%-9s%s\n", "running:", "no")
+		return nil
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(out, "%-9syes, http://%s\n", "running:", net.JoinHostPort(host, port))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get status: %s", resp.Status)
+	}
+	var status Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%-9s%v\n", "online:", status.Connected)
+	if status.Player != nil {
+		fmt.Fprintf(out, "%-9s%s %s\n", "player:", status.Player.State, status.Player.Token)
+	}
+	if v := status.Volume; v != nil && v.Volume != nil && v.Muted != nil {
+		fmt.Fprintf(out, "%-9s%d, muted %v\n", "volume:", *v.Volume, *v.Muted)
+	}
+	fmt.Fprintf(out, "%-9s%d\n", "alerts:", len(status.Alerts))
+	return nil
+}
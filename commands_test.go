@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		args []string
+		name string
+		rest []string
+		ok   bool
+	}{
+		{nil, "run", nil, true},
+		{[]string{"run"}, "run", nil, true},
+		{[]string{"status"}, "status", nil, true},
+		{[]string{"say", "今天", "天气"}, "say", []string{"今天", "天气"}, true},
+		{[]string{"record", "-d", "3s", "a.pcm"}, "record", []string{"-d", "3s", "a.pcm"}, true},
+		{[]string{"foo"}, "foo", nil, false},
+		{[]string{"-d", "3s"}, "-d", nil, false},
+	}
+	for _, c := range cases {
+		name, cmd, rest, err := parseCommand(c.args)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: expect ok %v, got %v", c.args, c.ok, err)
+			continue
+		}
+		if name != c.name || !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("%v: expect %s %v, got %s %v", c.args, c.name, c.rest, name, rest)
+		}
+		if c.ok && cmd != commands[c.name] {
+			t.Errorf("%v: expect command %s", c.args, c.name)
+		}
+	}
+}
+
+// 参数错误的时候在打开设备和发送请求之前返回错误
+func TestCommandArgs(t *testing.T) {
+	cases := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"record"}, "missing file"},
+		{[]string{"record", "a.pcm", "b.pcm"}, "missing file"},
+		{[]string{"record", "-d", "abc", "a.pcm"}, "invalid value"},
+		{[]string{"record", "-d", "-1s", "a.pcm"}, "bad duration"},
+		{[]string{"record", "-x", "a.pcm"}, "not defined"},
+		{[]string{"play"}, "missing file"},
+		{[]string{"play", "-rate", "abc", "a.pcm"}, "invalid value"},
+		{[]string{"say"}, "missing text"},
+		{[]string{"say", " "}, "missing text"},
+		{[]string{"replay"}, "missing session dir"},
+		{[]string{"replay", "a", "b"}, "missing session dir"},
+		{[]string{"devices", "-loopback", "-3s"}, "bad loopback duration"},
+		{[]string{"status", "now"}, "no arguments"},
+	}
+	for _, c := range cases {
+		_, cmd, rest, err := parseCommand(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cmd.run(rest)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: expect error %q, got %v", c.args, c.err, err)
+		}
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		code   int
+		body   string
+		lines  []string
+		hasErr bool
+	}{
+		{"running", http.StatusOK,
+			`{"connected":true,"player":{"state":"PLAYING","token":"t1"},"volume":{"volume":30,"muted":false},"alerts":[{"token":"a"},{"token":"b"}]}`,
+			[]string{"online:  true", "player:  PLAYING t1", "volume:  30, muted false", "alerts:  2"}, false},
+		{"offline", http.StatusOK, `{"connected":false}`,
+			[]string{"online:  false", "alerts:  0"}, false},
+		{"error", http.StatusServiceUnavailable, `{"error":"dueros is not running"}`, nil, true},
+		{"bad json", http.StatusOK, `{`, nil, true},
+	}
+	old := *httpAddr
+	defer func() {
+		*httpAddr = old
+	}()
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/status" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(c.code)
+			w.Write([]byte(c.body))
+		}))
+		*httpAddr = srv.Listener.Addr().String()
+		out := new(bytes.Buffer)
+		err := printStatus(out)
+		srv.Close()
+		if (err != nil) != c.hasErr {
+			t.Errorf("%s: expect error %v, got %v", c.name, c.hasErr, err)
+		}
+		if !strings.Contains(out.String(), "running: yes, http://"+*httpAddr) {
+			t.Errorf("%s: expect running, got\n%s", c.name, out)
+		}
+		for _, line := range c.lines {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Errorf("%s: expect %q in\n%s", c.name, line, out)
+			}
+		}
+	}
+
+	// 没有dueros在监听的时候显示没有运行
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*httpAddr = l.Addr().String()
+	l.Close()
+	out := new(bytes.Buffer)
+	err = printStatus(out)
+	if err != nil || !strings.Contains(out.String(), "running: no\n") {
+		t.Errorf("expect not running, got %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/auth"
+)
+
+var (
+	configFile = flag.String("config", "", "json config file, flags on the command line override it")
+)
+
+// Config 是配置文件的格式，每一项对应flag标签中的flag，命令行中指定的flag优先于配置文件
+type Config struct {
+	DuerOS struct {
+		Endpoint       *string `json:"endpoint" flag:"endpoint"`
+		DeviceID       *string `json:"device_id" flag:"device_id"`
+		EventQueueDir  *string `json:"event_queue_dir" flag:"event_queue_dir"`
+		EventQueueSize *int    `json:"event_queue_size" flag:"event_queue_size"`
+		EventTTL       *string `json:"event_ttl" flag:"event_ttl"`
+	} `json:"dueros"`
+
+	Auth struct {
+		ClientID     *string `json:"client_id" flag:"client_id"`
+		ClientSecret *string `json:"client_secret" flag:"client_secret"`
+		AccessToken  *string `json:"access_token" flag:"access_token"`
+		TokenFile    *string `json:"token_file" flag:"token_file"`
+		RedirectURI  *string `json:"redirect_uri" flag:"redirect_uri"`
+	} `json:"auth"`
+
+	Audio struct {
+		Input    *string `json:"input" flag:"audio_in"`
+		Output   *string `json:"output" flag:"audio_out"`
+		AEC      *bool   `json:"aec" flag:"aec"`
+		AECDelay *string `json:"aec_delay" flag:"aec_delay"`
+	} `json:"audio"`
+
+	Wakeup struct {
+		Method      *string   `json:"method" flag:"wakeup"`
+		Sensitivity *float64  `json:"sensitivity" flag:"sens"`
+		Resource    *string   `json:"resource" flag:"wakeup_resource"`
+		Model       *string   `json:"model" flag:"wakeup_model"`
+		Hotwords    []Hotword `json:"hotwords"`
+		Sound       *string   `json:"sound" flag:"wakeup_sound"`
+		Preroll     *string   `json:"preroll" flag:"preroll"`
+
+		EvdevDevice   *string `json:"evdev_device" flag:"evdev_device"`
+		EvdevKey      *int    `json:"evdev_key" flag:"evdev_key"`
+		GPIOPin       *int    `json:"gpio_pin" flag:"gpio_pin"`
+		GPIOActiveLow *bool   `json:"gpio_active_low" flag:"gpio_active_low"`
+	} `json:"wakeup"`
+
+	Alerts struct {
+		Sound *string `json:"sound" flag:"alert_sound"`
+	} `json:"alerts"`
+
+	Log struct {
+		File       *string `json:"file" flag:"log_file"`
+		Level      *string `json:"level" flag:"log_level"`
+		MaxSize    *int    `json:"max_size" flag:"log_max_size"`
+		MaxBackups *int    `json:"max_backups" flag:"log_max_backups"`
+	} `json:"log"`
+
+	HTTP struct {
+		Listen         *string `json:"listen" flag:"http_addr"`
+		AllowedOrigins *string `json:"allowed_origins" flag:"allowed_origins"`
+	} `json:"http"`
+
+	Record struct {
+		Dir *string `json:"dir" flag:"record_dir"`
+	} `json:"record"`
+}
+
+// loadConfig 读取配置文件，把命令行中没有指定的flag设置成配置文件中的值
+func loadConfig(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return fmt.Errorf("parse config %s: %s", file, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	err = applyConfig(reflect.ValueOf(cfg), "", set)
+	if err != nil {
+		return fmt.Errorf("config %s: %s", file, err)
+	}
+	if len(cfg.Wakeup.Hotwords) != 0 && !set["hotwords"] {
+		var hotwords []string
+		for _, h := range cfg.Wakeup.Hotwords {
+			if h.Action == "" {
+				h.Action = ActionListen
+			}
+			hotwords = append(hotwords, h.String())
+		}
+		flag.Set("hotwords", strings.Join(hotwords, ","))
+	}
+	return nil
+}
+
+func applyConfig(v reflect.Value, prefix string, set map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		key := prefix + strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Type.Kind() == reflect.Struct {
+			err := applyConfig(value, key+".", set)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("flag")
+		if name == "" || value.IsNil() || set[name] {
+			continue
+		}
+		err := flag.Set(name, fmt.Sprint(value.Elem().Interface()))
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// validateConfig 在启动的时候检查配置，返回所有的错误
+func validateConfig() error {
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	fileExists := func(name, file string) {
+		if _, err := os.Stat(file); err != nil {
+			check(fmt.Errorf("%s: %s", name, err))
+		}
+	}
+
+	check(auth.Validate())
+	if _, _, err := net.SplitHostPort(*httpAddr); err != nil {
+		check(fmt.Errorf("http_addr: %s", err))
+	}
+	if *eventQueueSize <= 0 {
+		check(errors.New("event_queue_size must be positive"))
+	}
+	if *preroll < 0 {
+		check(errors.New("preroll must not be negative"))
+	}
+	if *echoDelay < 0 || *echoDelay > audio.MaxEchoDelay {
+		check(fmt.Errorf("aec_delay must be in [0, %s]", audio.MaxEchoDelay))
+	}
+	if *wakeupSensitivity < 0 || *wakeupSensitivity > 1 {
+		check(errors.New("sens must be in [0, 1]"))
+	}
+	fileExists("wakeup_sound", *wakeupSound)
+	fileExists("alert_sound", *alertSound)
+	if _, err := audio.FindDevice(*audioIn, true); err != nil {
+		check(fmt.Errorf("audio_in: %s", err))
+	}
+	if _, err := audio.FindDevice(*audioOut, false); err != nil {
+		check(fmt.Errorf("audio_out: %s", err))
+	}
+
+	keyword := false
+	items, err := splitWakeupMethods(*wakeupMethod)
+	check(err)
+	for _, item := range items {
+		name, _, err := parseWakeupMethod(item)
+		check(err)
+		if name == KeywordListener {
+			keyword = true
+		}
+	}
+	if keyword {
+		fileExists("wakeup_resource", *wakeupResource)
+		if *hotwordsFlag == "" {
+			fileExists("wakeup_model", *wakeupModel)
+		} else {
+			hotwords, err := parseHotwords(*hotwordsFlag)
+			check(err)
+			for _, h := range hotwords {
+				fileExists("hotwords", h.Model)
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// resetFlags 让测试在新的flag.CommandLine上设置flag，返回的函数恢复原来的值
+func resetFlags() func() {
+	old := flag.CommandLine
+	values := make(map[string]string)
+	fs := flag.NewFlagSet(old.Name(), flag.ContinueOnError)
+	old.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = fs
+	return func() {
+		flag.CommandLine = old
+		old.VisitAll(func(f *flag.Flag) {
+			f.Value.Set(values[f.Name])
+		})
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "dueros*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		args   []string
+		want   map[string]string
+		err    string
+	}{
+		{
+			name:   "nested",
+			config: `{"audio": {"aec": true, "aec_delay": "150ms"}, "wakeup": {"method": "keyword,evdev:hold", "sensitivity": 0.5}}`,
+			want:   map[string]string{"aec": "true", "aec_delay": "150ms", "wakeup": "keyword,evdev:hold", "sens": "0.5"},
+		},
+		{
+			name:   "command line wins",
+			config: `{"wakeup": {"sensitivity": 0.5}, "http": {"listen": ":8080"}}`,
+			args:   []string{"-sens=0.6"},
+			want:   map[string]string{"sens": "0.6", "http_addr": ":8080"},
+		},
+		{
+			name:   "zero sensitivity",
+			config: `{"wakeup": {"sensitivity": 0}}`,
+			want:   map[string]string{"sens": "0"},
+		},
+		{
+			name: "hotwords",
+			config: `{"wakeup": {"hotwords": [{"model": "a.pmdl", "sensitivity": 0, "action": "stop"},
+				{"model": "b.pmdl", "sensitivity": 0.4}, {"model": "c.pmdl"}]}}`,
+			want: map[string]string{"hotwords": "a.pmdl:0:stop,b.pmdl:0.4:listen,c.pmdl::listen"},
+		},
+		{
+			name:   "hotwords from command line",
+			config: `{"wakeup": {"hotwords": [{"model": "a.pmdl"}]}}`,
+			args:   []string{"-hotwords=b.pmdl"},
+			want:   map[string]string{"hotwords": "b.pmdl"},
+		},
+		{
+			name:   "unknown field",
+			config: `{"audio": {"acc": true}}`,
+			err:    `unknown field "acc"`,
+		},
+		{
+			name:   "bad value",
+			config: `{"wakeup": {"preroll": "1 minute"}}`,
+			err:    "wakeup.preroll",
+		},
+	}
+	for _, c := range cases {
+		restore := resetFlags()
+		file := writeConfig(t, c.config)
+		err := flag.CommandLine.Parse(c.args)
+		if err == nil {
+			err = loadConfig(file)
+		}
+		os.Remove(file)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expect error %q, got %v", c.name, c.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		for name, want := range c.want {
+			if got := flag.Lookup(name).Value.String(); got != want {
+				t.Errorf("%s: expect %s=%s, got %s", c.name, name, want, got)
+			}
+		}
+		restore()
+	}
+}
+
+func TestLoadConfigHotwordSensitivity(t *testing.T) {
+	defer resetFlags()()
+	file := writeConfig(t, `{"wakeup": {"sensitivity": 0.3, "hotwords": [{"model": "a.pmdl", "sensitivity": 0}, {"model": "b.pmdl"}]}}`)
+	defer os.Remove(file)
+	err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hotwords, err := parseHotwords(*hotwordsFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 配置为0的灵敏度不会被当成没有设置，没有设置的使用wakeup.sensitivity
+	if *hotwords[0].Sensitivity != 0 || *hotwords[1].Sensitivity != 0.3 {
+		t.Errorf("unexpected sensitivity %g %g", *hotwords[0].Sensitivity, *hotwords[1].Sensitivity)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-sens=1.5"}, "sens must be in [0, 1]"},
+		{[]string{"-preroll=-1s"}, "preroll must not be negative"},
+		{[]string{"-aec_delay=-1s"}, "aec_delay must be in [0, 1s]"},
+		{[]string{"-aec_delay=2s"}, "aec_delay must be in [0, 1s]"},
+		{[]string{"-event_queue_size=0"}, "event_queue_size must be positive"},
+		{[]string{"-http_addr=8080"}, "http_addr"},
+		{[]string{"-wakeup_sound=testdata/missing.mp3"}, "wakeup_sound"},
+		{[]string{"-wakeup=keyword,morse"}, "morse"},
+		{[]string{"-wakeup=http,http:hold"}, "duplicate wakeup method http"},
+		{[]string{"-hotwords=a.pmdl:2"}, "bad sensitivity"},
+	}
+	for _, c := range cases {
+		restore := resetFlags()
+		err := flag.CommandLine.Parse(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 测试环境中可能没有录音设备和授权，只检查期望的错误
+		err = validateConfig()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: expect error %q, got %v", c.args, c.want, err)
+		}
+		restore()
+	}
+
+	defer resetFlags()()
+	flag.CommandLine.Parse([]string{"-sens=0", "-preroll=0s"})
+	err := validateConfig()
+	if err != nil && strings.Contains(err.Error(), "sens") {
+		t.Errorf("expect zero sensitivity valid, got %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/icexin/dueros/audio"
+)
+
+// devicesCommand 列出音频设备，检查播放和录音
+func devicesCommand(args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ContinueOnError)
+	in := fs.String("in", *audioIn, "input device to check, index, name or part of name")
+	out := fs.String("out", *audioOut, "output device to check, index, name or part of name")
+	tone := fs.Bool("tone", false, "play a test tone on the output device")
+	loopback := fs.Duration("loopback", 0, "record this long from the input device and play it back")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *loopback < 0 {
+		return fmt.Errorf("bad loopback duration %s", *loopback)
+	}
+	audio.InputDevice = *in
+	audio.OutputDevice = *out
+
+	devices, err := audio.ListDevices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		var marks []string
+		if d.DefaultInput {
+			marks = append(marks, "default input")
+		}
+		if d.DefaultOutput {
+			marks = append(marks, "default output")
+		}
+		fmt.Printf("%2d %s (%s)", d.Index, d.Name, d.HostApi)
+		if len(marks) != 0 {
+			fmt.Printf(" [%s]", strings.Join(marks, ", "))
+		}
+		fmt.Println()
+		if d.MaxInputChannels > 0 {
+			fmt.Printf("   input:  %d channels, rates %s\n", d.MaxInputChannels, formatRates(d.InputRates))
+		}
+		if d.MaxOutputChannels > 0 {
+			fmt.Printf("   output: %d channels, rates %s\n", d.MaxOutputChannels, formatRates(d.OutputRates))
+		}
+	}
+
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("%s: %s\n", name, err)
+			failed = true
+		}
+	}
+	if _, err := audio.FindDevice(*in, true); err != nil {
+		check("input", err)
+	}
+	if _, err := audio.FindDevice(*out, false); err != nil {
+		check("output", err)
+	}
+	if *tone && !failed {
+		fmt.Println(">>> 播放测试音")
+		check("tone", audio.PlayTone(440, time.Second))
+	}
+	if *loopback > 0 && !failed {
+		fmt.Printf(">>> 录音%s之后播放\n", *loopback)
+		peak, err := audio.Loopback(*loopback)
+		check("loopback", err)
+		if err == nil {
+			fmt.Printf(">>> 录音峰值 %d/32767\n", peak)
+			if peak < 100 {
+				fmt.Println(">>> 录音几乎是静音，检查输入设备和麦克风音量")
+			}
+		}
+	}
+	if failed {
+		return errors.New("check failed")
+	}
+	return nil
+}
+
+func formatRates(rates []int) string {
+	if len(rates) == 0 {
+		return "none"
+	}
+	var s []string
+	for _, r := range rates {
+		s = append(s, fmt.Sprint(r))
+	}
+	return strings.Join(s, " ")
+}
@@ -1,20 +1,22 @@
 package duer
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/icexin/dueros/auth"
+	"github.com/icexin/dueros/hub"
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/metrics"
 	"github.com/icexin/dueros/proto"
+	"github.com/pkg/errors"
 	"github.com/twinj/uuid"
 )
 
@@ -26,17 +28,16 @@ var (
 	OS *DuerOS
 )
 
-func mustToken() string {
-	token, err := auth.GetToken()
-	if err != nil {
-		panic(err)
-	}
-	return token
-}
+var (
+	eventsPosted          = metrics.NewCounter("dueros_events_posted_total", "events posted to dueros", "namespace", "name", "result")
+	directivesReceived    = metrics.NewCounter("dueros_directives_received_total", "directives received from dueros", "namespace")
+	downchannelReconnects = metrics.NewCounter("dueros_downchannel_reconnects_total", "reconnects of the down channel")
+	pingFailures          = metrics.NewCounter("dueros_ping_failures_total", "failed pings")
+)
 
-func requestURI(s string) string {
+func (d *DuerOS) requestURI(s string) string {
 	p := path.Join("dcs/v1", s)
-	return fmt.Sprintf("https://%s/%s", DuerOSHost, p)
+	return fmt.Sprintf("%s/%s", d.endpoint, p)
 }
 
 type Registry interface {
@@ -44,35 +45,86 @@ type Registry interface {
 	Context() []*proto.Message
 }
 
+// Capabler 是可以声明设备能力的Registry，能力会在SynchronizeState事件中上报
+type Capabler interface {
+	Capabilities() []proto.Capability
+}
+
+// Options 是DuerOS的可选配置
+type Options struct {
+	// 服务端地址，默认为https://DuerOSHost
+	Endpoint string
+	// 设备id，默认每次启动随机生成
+	DeviceID string
+	// 事件队列持久化的目录，为空的时候只保存在内存中
+	QueueDir string
+	// 事件队列的最大长度，默认为DefaultQueueSize
+	QueueSize int
+	// 事件发送失败之后最长的重试时间，默认为DefaultEventTTL
+	EventTTL time.Duration
+	// 不为空的时候所有发送的事件和收到的指令都会被记录下来
+	Recorder *Recorder
+}
+
 type DuerOS struct {
 	c        *http.Client
+	endpoint string
 	deviceid string
 
-	eventch  chan *proto.Message
+	queue    *eventQueue
 	directch chan *proto.Message
 
 	registry Registry
+	recorder *Recorder
+
+	// 下行通道是否已经建立，原子读写
+	connected int32
+	// 没有token的时候仍然发送请求，用于回放到本地的测试服务
+	skipAuth bool
 }
 
-func NewDuerOS(r Registry) *DuerOS {
+func newDuerOS(r Registry, endpoint string, opt Options) (*DuerOS, error) {
 	client := &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost: 1,
 		},
 	}
+	queue, err := newEventQueue(opt.QueueDir, opt.QueueSize, opt.EventTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceid := opt.DeviceID
+	if deviceid == "" {
+		deviceid = "icexin-dueros-" + uuid.NewV4().String()
+	}
 
-	d := &DuerOS{
+	return &DuerOS{
 		c:        client,
-		deviceid: "icexin-dueros-" + uuid.NewV4().String(),
-		eventch:  make(chan *proto.Message, 2),
+		endpoint: endpoint,
+		deviceid: deviceid,
+		queue:    queue,
 		directch: make(chan *proto.Message, 2),
 		registry: r,
+		recorder: opt.Recorder,
+	}, nil
+}
+
+func NewDuerOS(r Registry, opt Options) (*DuerOS, error) {
+	endpoint := opt.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + DuerOSHost
 	}
+	d, err := newDuerOS(r, endpoint, opt)
+	if err != nil {
+		return nil, err
+	}
+	hub.Publish(hub.TypeConnection, hub.Connection{Connected: false})
 	go d.handleDownChannelLoop()
 	go d.handlePingLoop()
 	go d.handleEventLoop()
 	go d.handleDirectLoop()
-	return d
+	return d, nil
 }
 
 func (d *DuerOS) handlePingLoop() {
@@ -84,84 +136,225 @@ func (d *DuerOS) handlePingLoop() {
 }
 
 func (d *DuerOS) handleDownChannelLoop() {
-	for {
+	for i := 0; ; i++ {
+		if i > 0 {
+			downchannelReconnects.Inc()
+		}
 		resp, err := d.get("/directives")
 		if err != nil {
-			resp.Close()
-			log.Printf("downchannel error:%s", err)
+			logger.Warnf("downchannel error:%s", err)
+			d.setConnected(false)
 			time.Sleep(time.Second * 3)
 			continue
 		}
+		d.setConnected(true)
+		// 下行通道建立之后同步一次设备状态
+		d.SynchronizeState()
 		d.handleResponse(resp)
+		d.setConnected(false)
+	}
+}
+
+// setConnected 修改下行通道的状态，状态变化的时候通知订阅者
+func (d *DuerOS) setConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.connected, v) != v {
+		hub.Publish(hub.TypeConnection, hub.Connection{Connected: connected})
+	}
+}
+
+// Connected 返回下行通道是否已经建立
+func (d *DuerOS) Connected() bool {
+	return atomic.LoadInt32(&d.connected) == 1
+}
+
+// PendingEvents 返回还没有发送成功的事件数
+func (d *DuerOS) PendingEvents() int {
+	return d.queue.Len()
+}
+
+// SynchronizeState 上报设备的状态和能力，注册的服务发生变化之后也应该调用
+func (d *DuerOS) SynchronizeState() {
+	payload := &proto.SynchronizeStatePayload{}
+	if c, ok := d.registry.(Capabler); ok {
+		payload.Capabilities = c.Capabilities()
 	}
+	d.PostEvent(proto.NewMessage(proto.NamespaceSystem+".SynchronizeState", payload))
 }
 
+// PostEvent 把事件放入发送队列
 func (d *DuerOS) PostEvent(m *proto.Message) {
-	d.eventch <- m
+	hub.Publish(hub.TypeEvent, m)
+	d.queue.push(m)
+}
+
+// Send 立即发送事件，依次处理完响应中的指令之后返回，发送失败不会重试，用于命令行中的一次性请求
+func (d *DuerOS) Send(m *proto.Message) error {
+	hub.Publish(hub.TypeEvent, m)
+	defer closeAttach(m)
+	resp, err := d.postEvent(m, true)
+	if err == proto.ErrEmptyBody {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.readResponse(resp, d.dispatch)
+	return nil
+}
+
+// refreshToken 在服务端返回401的时候刷新token，测试的时候可以替换
+var refreshToken = auth.RefreshToken
+
+// retryable 判断事件发送失败之后是否需要重试，服务端明确拒绝的请求不再重试。
+// 401在handleEventLoop中刷新token之后只重试一次，避免阻塞后面的事件
+func retryable(err error) bool {
+	if e, ok := err.(*proto.StatusError); ok {
+		return e.StatusCode >= 500 ||
+			e.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func unauthorized(err error) bool {
+	e, ok := err.(*proto.StatusError)
+	return ok && e.StatusCode == http.StatusUnauthorized
 }
 
 func (d *DuerOS) handleEventLoop() {
-	for event := range d.eventch {
-		resp, err := d.postEvent(event)
-		if err == proto.ErrEmptyBody {
+	var (
+		retrying *queuedEvent
+		interval time.Duration
+	)
+	for {
+		e := d.queue.next()
+		event := e.Event
+		if d.endpoint == "" {
+			logger.Message(event).Infof("offline, drop event")
+			d.queue.remove(e)
+			closeAttach(event)
 			continue
 		}
-		if err != nil {
-			log.Print(err)
+		resp, err := d.postEvent(event, !e.attempted)
+		e.attempted = true
+		if unauthorized(err) && !e.refreshed {
+			e.refreshed = true
+			_, rerr := refreshToken()
+			// 实时事件的录音已经被读取了一部分，刷新token之后也不能重新发送
+			if rerr == nil && !e.realtime() {
+				logger.Message(event).Warnf("post event unauthorized, retry with refreshed token")
+				continue
+			}
+			if rerr != nil {
+				logger.Message(event).Errorf("refresh token error:%s", rerr)
+			}
+		}
+		if err != nil && err != proto.ErrEmptyBody && !e.realtime() && retryable(err) {
+			if retrying != e {
+				retrying = e
+				interval = minRetryInterval
+			}
+			logger.Message(event).Warnf("post event error:%s, retry after %s", err, interval)
+			d.queue.wait(interval)
+			interval *= 2
+			if interval > maxRetryInterval {
+				interval = maxRetryInterval
+			}
 			continue
 		}
-		d.handleResponse(resp)
+		d.queue.remove(e)
+		if err == nil {
+			d.handleResponse(resp)
+		} else if err != proto.ErrEmptyBody {
+			logger.Message(event).Errorf("post event error:%s", err)
+		}
+		closeAttach(event)
+	}
+}
+
+// closeAttach 在事件的响应处理完之后关闭附件，此时录音已经上传完毕或者请求已经失败
+func closeAttach(e *proto.Message) {
+	if e.Attach != nil {
+		e.Attach.Close()
 	}
 }
 
 func (d *DuerOS) handleDirectLoop() {
 	for direct := range d.directch {
-		err := d.registry.Dispatch(direct)
-		if err != nil {
-			log.Print(err)
+		d.dispatch(direct)
+	}
+}
+
+func (d *DuerOS) dispatch(direct *proto.Message) {
+	err := d.registry.Dispatch(direct)
+	if err != nil {
+		logger.Message(direct).Errorf("%s", err)
+		errorType := proto.ExceptionInternalError
+		if errors.Cause(err) == proto.ErrUnsupportedDirective {
+			errorType = proto.ExceptionUnsupportedOperation
 		}
+		d.reportException(direct.RawJSON, errorType, err)
+	}
+	// 没有被读取的附件不再需要继续接收
+	for _, attach := range direct.Attachments {
+		attach.Close()
 	}
 }
 
 func (d *DuerOS) ping() {
 	resp, err := d.get("/ping")
 	if err != nil {
-		log.Print(err)
+		logger.Warnf("ping error:%s", err)
+		pingFailures.Inc()
 		return
 	}
 	resp.Close()
 }
 
 func (d *DuerOS) handleResponse(resp *proto.ResponseReader) {
+	d.readResponse(resp, func(direct *proto.Message) {
+		d.directch <- direct
+	})
+}
+
+// readResponse 读取响应中的所有指令，记录之后交给fn处理
+func (d *DuerOS) readResponse(resp *proto.ResponseReader, fn func(direct *proto.Message)) {
 	defer resp.Close()
 	for {
 		direct, err := resp.ReadDirective()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			log.Printf("%#v", err)
+		if e, ok := err.(*proto.DirectiveError); ok {
+			logger.Errorf("%s", err)
+			d.reportException(e.Raw, proto.ExceptionUnexpectedInformation, e.Err)
 			continue
 		}
-		log.Printf("directive: %s.%s:%s ", direct.Header.Namespace, direct.Header.Name, direct.PayloadJSON)
-		if direct.Header.Namespace == "ai.dueros.device_interface.voice_output" &&
-			direct.Header.Name == "Speak" {
-			rc, err := resp.ReadAttach()
-			if err != nil {
-				log.Printf("read attach error:%s", err)
-				continue
-			}
-			buf := new(bytes.Buffer)
-			io.Copy(buf, rc)
-			rc.Close()
-			direct.Attach = ioutil.NopCloser(buf)
+		if err != nil {
+			logger.Errorf("read directive error:%s", err)
+			break
 		}
-		d.directch <- direct
+		logger.Message(direct).Infof("directive")
+		directivesReceived.Inc(direct.Header.Namespace)
+		logger.Message(direct).Debugf("directive payload:%s", direct.PayloadJSON)
+		if d.recorder != nil {
+			d.recorder.RecordDirective(direct)
+		}
+		hub.Publish(hub.TypeDirective, direct)
+		fn(direct)
 	}
 }
 
+// reportException 通过ExceptionEncountered事件上报无法处理的指令
+func (d *DuerOS) reportException(unparsed, errorType string, err error) {
+	d.PostEvent(proto.NewExceptionEncountered(unparsed, errorType, err))
+}
+
 func (d *DuerOS) get(method string) (*proto.ResponseReader, error) {
-	req, err := http.NewRequest("GET", requestURI(method), nil)
+	req, err := http.NewRequest("GET", d.requestURI(method), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -176,43 +369,78 @@ func newMimeHeader(contentType, fieldName string) textproto.MIMEHeader {
 	return h
 }
 
-func (d *DuerOS) postEvent(e *proto.Message) (*proto.ResponseReader, error) {
+// postEvent 发送事件，record为true的时候记录事件，重试的时候不再重复记录
+func (d *DuerOS) postEvent(e *proto.Message, record bool) (*proto.ResponseReader, error) {
 	msg := map[string]interface{}{
 		"clientContext": d.registry.Context(),
 		"event":         e,
 	}
 	buf, _ := json.Marshal(msg)
-	log.Printf("request:%s", buf)
+	logger.Message(e).Infof("post event")
+	logger.Message(e).Debugf("request:%s", buf)
+	if d.recorder != nil && record {
+		d.recorder.RecordEvent(buf, e)
+	}
+	resp, err := d.post(buf, e.Attach)
+	result := "ok"
+	if err != nil && err != proto.ErrEmptyBody {
+		result = "error"
+	}
+	eventsPosted.Inc(e.Header.Namespace, e.Header.Name, result)
+	return resp, err
+}
 
+// post 发送metadata和音频附件
+func (d *DuerOS) post(metadata []byte, attach io.Reader) (*proto.ResponseReader, error) {
 	pr, pw := io.Pipe()
 	w := multipart.NewWriter(pw)
 	go func() {
-		// write json metadata
-		partWriter, _ := w.CreatePart(newMimeHeader("application/json", "metadata"))
-		partWriter.Write(buf)
-
-		// write audio attachment
-		if e.Attach != nil {
-			partWriter, _ = w.CreatePart(newMimeHeader("application/octet-stream", "audio"))
-			_, err := io.CopyBuffer(partWriter, e.Attach, make([]byte, 320))
-			if err != nil && err != io.EOF {
-				log.Fatalf("%+v", err)
-			}
+		err := writeMultipart(w, metadata, attach)
+		// 请求失败的时候http client会关闭pr，写入返回io.ErrClosedPipe
+		if err != nil && err != io.ErrClosedPipe {
+			logger.Errorf("write request body error:%+v", err)
 		}
-		// flush multipart content
-		w.Close()
-
 		// tell http client EOF of http body
-		pw.Close()
+		pw.CloseWithError(err)
 	}()
-	req, _ := http.NewRequest("POST", requestURI("/events"), pr)
+	req, _ := http.NewRequest("POST", d.requestURI("/events"), pr)
 	req.Header.Set("Content-Type", w.FormDataContentType())
 	return d.doRequest(req)
 }
 
+// writeMultipart 写入json metadata和音频附件
+func writeMultipart(w *multipart.Writer, metadata []byte, attach io.Reader) error {
+	partWriter, err := w.CreatePart(newMimeHeader("application/json", "metadata"))
+	if err != nil {
+		return err
+	}
+	_, err = partWriter.Write(metadata)
+	if err != nil {
+		return err
+	}
+	if attach != nil {
+		partWriter, err = w.CreatePart(newMimeHeader("application/octet-stream", "audio"))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyBuffer(partWriter, attach, make([]byte, 320))
+		if err != nil {
+			return err
+		}
+	}
+	// flush multipart content
+	return w.Close()
+}
+
 func (d *DuerOS) doRequest(req *http.Request) (*proto.ResponseReader, error) {
+	token, err := auth.GetToken()
+	if err != nil && !d.skipAuth {
+		return nil, err
+	}
 	req.Header.Set("dueros-device-id", d.deviceid)
-	req.Header.Set("authorization", "Bearer "+mustToken())
+	if err == nil {
+		req.Header.Set("authorization", "Bearer "+token)
+	}
 	resp, err := d.c.Do(req)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,145 @@
+package duer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icexin/dueros/auth"
+	"github.com/icexin/dueros/proto"
+	"github.com/pkg/errors"
+)
+
+type errorRegistry struct {
+	err error
+}
+
+func (r *errorRegistry) Dispatch(m *proto.Message) error {
+	return r.err
+}
+
+func (r *errorRegistry) Context() []*proto.Message {
+	return nil
+}
+
+func TestDispatchReportException(t *testing.T) {
+	cases := []struct {
+		err       error
+		errorType string
+	}{
+		{errors.Wrap(proto.ErrUnsupportedDirective, "can't find service"), proto.ExceptionUnsupportedOperation},
+		{errors.New("handler failed"), proto.ExceptionInternalError},
+	}
+	for _, c := range cases {
+		d, err := newDuerOS(&errorRegistry{err: c.err}, "", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := `{"header":{"namespace":"foo","name":"Bar"},"payload":{}}`
+		d.dispatch(&proto.Message{RawJSON: raw})
+
+		e := d.queue.next()
+		if e.Event.Header.Name != "ExceptionEncountered" {
+			t.Fatalf("expect ExceptionEncountered, got %s", e.Event.Header.Name)
+		}
+		payload := e.Event.Payload.(*proto.ExceptionEncounteredPayload)
+		if payload.Error.Type != c.errorType {
+			t.Errorf("expect %s, got %s", c.errorType, payload.Error.Type)
+		}
+		if payload.UnparsedDirective != raw {
+			t.Errorf("bad unparsed directive: %s", payload.UnparsedDirective)
+		}
+	}
+}
+
+type capRegistry struct {
+	errorRegistry
+}
+
+func (r *capRegistry) Capabilities() []proto.Capability {
+	return []proto.Capability{{Interface: "foo", Directives: []string{"Bar"}}}
+}
+
+func TestSynchronizeState(t *testing.T) {
+	d, err := newDuerOS(&capRegistry{}, "", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SynchronizeState()
+	e := d.queue.next()
+	if e.Event.Header.Name != "SynchronizeState" {
+		t.Fatalf("expect SynchronizeState, got %s", e.Event.Header.Name)
+	}
+	payload := e.Event.Payload.(*proto.SynchronizeStatePayload)
+	if len(payload.Capabilities) != 1 || payload.Capabilities[0].Interface != "foo" {
+		t.Errorf("bad capabilities: %v", payload.Capabilities)
+	}
+}
+
+func TestUnauthorizedEventDropped(t *testing.T) {
+	cases := []struct {
+		name     string
+		realtime bool
+		posts    int32
+	}{
+		{"retry once", false, 2},
+		// 实时事件的录音已经读取过，刷新token之后不再重新发送
+		{"realtime", true, 1},
+	}
+	for _, c := range cases {
+		var first int32
+		second := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(string(body), `"name":"First"`) {
+				atomic.AddInt32(&first, 1)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			second <- struct{}{}
+		}))
+
+		var refreshes int32
+		refreshToken = func() (string, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return "new", nil
+		}
+
+		d, err := newDuerOS(&errorRegistry{}, server.URL, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.skipAuth = true
+		go d.handleEventLoop()
+		event := proto.NewMessage("foo.First", nil)
+		attach := &closeCounter{Reader: strings.NewReader("pcm")}
+		if c.realtime {
+			event.Attach = attach
+		}
+		d.PostEvent(event)
+		d.PostEvent(proto.NewMessage("foo.Second", nil))
+
+		// 第一个事件被丢弃之后不会阻塞后面的事件
+		select {
+		case <-second:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: event after unauthorized event not sent", c.name)
+		}
+		if n := atomic.LoadInt32(&first); n != c.posts {
+			t.Errorf("%s: expect unauthorized event posted %d times, got %d", c.name, c.posts, n)
+		}
+		if n := atomic.LoadInt32(&refreshes); n != 1 {
+			t.Errorf("%s: expect 1 token refresh, got %d", c.name, n)
+		}
+		if c.realtime && attach.closed != 1 {
+			t.Errorf("%s: expect attachment closed once, got %d", c.name, attach.closed)
+		}
+		server.Close()
+	}
+	refreshToken = auth.RefreshToken
+}
@@ -0,0 +1,276 @@
+package duer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+)
+
+const (
+	DefaultQueueSize = 100
+	DefaultEventTTL  = 10 * time.Minute
+
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+type queuedEvent struct {
+	Seq   uint64         `json:"seq"`
+	Time  time.Time      `json:"time"`
+	Event *proto.Message `json:"event"`
+
+	// 带附件的事件(语音请求)是实时的流，不会持久化，也不会重试
+	persisted bool
+	// 已经发送过一次，重试的时候不再记录
+	attempted bool
+	// 服务端返回401之后已经刷新过token，再次返回401的时候丢弃
+	refreshed bool
+}
+
+func (e *queuedEvent) realtime() bool {
+	return e.Event.Attach != nil
+}
+
+// eventQueue 是有界的事件队列，没有附件的事件在发送成功之前会保存在dir中，重启之后继续发送。
+// 队列中的事件按照顺序发送，带附件的语音请求会排在等待重试的事件之前，
+// 超过ttl的事件会被丢弃
+type eventQueue struct {
+	dir  string
+	size int
+	ttl  time.Duration
+
+	mutex  sync.Mutex
+	items  []*queuedEvent
+	seq    uint64
+	notify chan struct{}
+}
+
+// newEventQueue 创建事件队列并加载dir中未发送的事件，dir为空的时候只保存在内存中
+func newEventQueue(dir string, size int, ttl time.Duration) (*eventQueue, error) {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultEventTTL
+	}
+	q := &eventQueue{
+		dir:    dir,
+		size:   size,
+		ttl:    ttl,
+		notify: make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *eventQueue) file(e *queuedEvent) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", e.Seq))
+}
+
+func (q *eventQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		name := filepath.Join(q.dir, f.Name())
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		e := new(queuedEvent)
+		err = json.Unmarshal(buf, e)
+		if err != nil || e.Event == nil {
+			logger.Warnf("drop bad queued event %s:%v", name, err)
+			os.Remove(name)
+			continue
+		}
+		e.persisted = true
+		q.items = append(q.items, e)
+		if e.Seq >= q.seq {
+			q.seq = e.Seq + 1
+		}
+	}
+	sort.Slice(q.items, func(i, j int) bool {
+		return q.items[i].Seq < q.items[j].Seq
+	})
+	if len(q.items) > 0 {
+		logger.Infof("load %d queued events from %s", len(q.items), q.dir)
+	}
+	return nil
+}
+
+func (q *eventQueue) save(e *queuedEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	name := q.file(e)
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (q *eventQueue) push(m *proto.Message) {
+	q.mutex.Lock()
+	e := &queuedEvent{
+		Seq:   q.seq,
+		Time:  time.Now(),
+		Event: m,
+	}
+	q.seq++
+
+	if len(q.items) >= q.size {
+		// 优先丢弃最早的非实时事件
+		dropped := q.items[0]
+		for _, item := range q.items {
+			if !item.realtime() {
+				dropped = item
+				break
+			}
+		}
+		q.dropLocked(dropped)
+		logger.Message(dropped.Event).Warnf("event queue full, drop event")
+	}
+
+	if e.realtime() {
+		// 排在所有等待发送的非实时事件之前
+		i := 0
+		for i < len(q.items) && q.items[i].realtime() {
+			i++
+		}
+		q.items = append(q.items, nil)
+		copy(q.items[i+1:], q.items[i:])
+		q.items[i] = e
+	} else {
+		if q.dir != "" {
+			err := q.save(e)
+			if err != nil {
+				logger.Errorf("save event error:%s", err)
+			} else {
+				e.persisted = true
+			}
+		}
+		q.items = append(q.items, e)
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next 返回队首的事件，队列为空的时候阻塞等待
+func (q *eventQueue) next() *queuedEvent {
+	for {
+		q.mutex.Lock()
+		q.expireLocked()
+		if len(q.items) > 0 {
+			e := q.items[0]
+			q.mutex.Unlock()
+			return e
+		}
+		q.mutex.Unlock()
+		<-q.notify
+	}
+}
+
+func (q *eventQueue) expireLocked() {
+	now := time.Now()
+	var expired []*queuedEvent
+	for _, e := range q.items {
+		if now.Sub(e.Time) > q.ttl {
+			expired = append(expired, e)
+		}
+	}
+	for _, e := range expired {
+		logger.Message(e.Event).Warnf("drop expired event")
+		q.dropLocked(e)
+	}
+}
+
+// remove 事件发送成功或者不需要重试的时候从队列中删除
+func (q *eventQueue) remove(e *queuedEvent) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.removeLocked(e)
+}
+
+// dropLocked 丢弃没有发送的事件，同时关闭实时事件的附件，否则录音流会一直打开
+func (q *eventQueue) dropLocked(e *queuedEvent) {
+	q.removeLocked(e)
+	closeAttach(e.Event)
+}
+
+func (q *eventQueue) removeLocked(e *queuedEvent) {
+	for i, item := range q.items {
+		if item == e {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	if e.persisted {
+		os.Remove(q.file(e))
+		e.persisted = false
+	}
+}
+
+// wait 等待d时间之后重试，期间有实时事件入队的时候提前返回
+func (q *eventQueue) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-q.notify:
+			q.mutex.Lock()
+			realtime := len(q.items) > 0 && q.items[0].realtime()
+			q.mutex.Unlock()
+			if realtime {
+				return
+			}
+		}
+	}
+}
+
+func (q *eventQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// PendingEvents 返回dir中持久化的还没有发送成功的事件数
+func PendingEvents(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	return len(files), nil
+}
@@ -0,0 +1,121 @@
+package duer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icexin/dueros/proto"
+)
+
+func newTestEvent(token string) *proto.Message {
+	return proto.NewMessage(proto.NamespaceAudioPlayer+".PlaybackStarted", &proto.PlaybackEventPayload{
+		Token: token,
+	})
+}
+
+func eventToken(e *queuedEvent) string {
+	return e.Event.Payload.(*proto.PlaybackEventPayload).Token
+}
+
+func TestEventQueuePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dueros-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newEventQueue(dir, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(newTestEvent("a"))
+	q.push(newTestEvent("b"))
+	// 超过队列长度，丢弃最早的a
+	q.push(newTestEvent("c"))
+
+	// 重新加载之后顺序不变
+	q, err = newEventQueue(dir, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expect 2 events, got %d", q.Len())
+	}
+	if n, _ := PendingEvents(dir); n != 2 {
+		t.Errorf("expect 2 pending events, got %d", n)
+	}
+	e := q.next()
+	if eventToken(e) != "b" {
+		t.Errorf("expect b, got %s", eventToken(e))
+	}
+	q.remove(e)
+	e = q.next()
+	if eventToken(e) != "c" {
+		t.Errorf("expect c, got %s", eventToken(e))
+	}
+	q.remove(e)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("expect empty dir, got %d files", len(files))
+	}
+}
+
+func TestEventQueueRealtimeAndExpire(t *testing.T) {
+	q, err := newEventQueue("", 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(newTestEvent("a"))
+	listen := proto.NewMessage(proto.NamespaceVoiceInput+".ListenStarted", &proto.ListenStartedPayload{})
+	listen.Attach = ioutil.NopCloser(strings.NewReader(""))
+	q.push(listen)
+
+	e := q.next()
+	if e.Event != listen {
+		t.Fatalf("expect realtime event first, got %s", e.Event.Header.Name)
+	}
+	q.remove(e)
+
+	time.Sleep(100 * time.Millisecond)
+	q.push(newTestEvent("b"))
+	e = q.next()
+	if eventToken(e) != "b" {
+		t.Errorf("expect expired a dropped, got %s", eventToken(e))
+	}
+}
+
+func TestEventQueueDropCloseAttach(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+		ttl  time.Duration
+		wait time.Duration
+	}{
+		{"full", 1, time.Minute, 0},
+		{"expired", 10, 50 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, c := range cases {
+		q, err := newEventQueue("", c.size, c.ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listen := proto.NewMessage(proto.NamespaceVoiceInput+".ListenStarted", &proto.ListenStartedPayload{})
+		attach := &closeCounter{Reader: strings.NewReader("pcm")}
+		listen.Attach = attach
+		q.push(listen)
+		time.Sleep(c.wait)
+		q.push(newTestEvent("a"))
+		e := q.next()
+		if eventToken(e) != "a" {
+			t.Errorf("%s: expect realtime event dropped, got %s", c.name, e.Event.Header.Name)
+		}
+		// 丢弃的实时事件的录音流需要关闭
+		if attach.closed != 1 {
+			t.Errorf("%s: expect attachment closed once, got %d", c.name, attach.closed)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package duer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+)
+
+const (
+	RecordEvent     = "event"
+	RecordDirective = "directive"
+
+	indexFile = "index.jsonl"
+)
+
+// Record 是session目录中index.jsonl的一行
+type Record struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// 事件为发送的metadata(包含clientContext)，指令为原始的指令内容
+	Message json.RawMessage `json:"message"`
+	// Content-ID到附件文件名的映射，事件的音频附件使用"audio"作为key
+	Attachments map[string]string `json:"attachments,omitempty"`
+}
+
+// Recorder 把发送的事件和收到的指令连同附件记录到一个session目录中，用于复现问题。
+// 附件在被读取的时候才会写入文件，没有被读取的部分不会被记录
+type Recorder struct {
+	dir string
+
+	mutex sync.Mutex
+	index *os.File
+	seq   int
+}
+
+// NewRecorder 在dir下面创建一个以当前时间命名的session目录
+func NewRecorder(dir string) (*Recorder, error) {
+	session := filepath.Join(dir, "session-"+time.Now().Format("20060102-150405"))
+	err := os.MkdirAll(session, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(session, indexFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir:   session,
+		index: f,
+	}, nil
+}
+
+// Dir 返回session目录
+func (r *Recorder) Dir() string {
+	return r.dir
+}
+
+// RecordEvent 记录事件的metadata，事件的附件被替换成边读边记录的reader，
+// 每个事件只需要记录一次，重试的时候不再记录
+func (r *Recorder) RecordEvent(metadata []byte, e *proto.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record := r.newRecord(RecordEvent, metadata)
+	if e.Attach != nil {
+		name := fmt.Sprintf("%d-audio.pcm", record.Seq)
+		e.Attach = r.tee(e.Attach, name)
+		record.Attachments = map[string]string{"audio": name}
+	}
+	r.write(record)
+}
+
+// RecordDirective 记录指令，指令的附件被替换成边读边记录的reader
+func (r *Recorder) RecordDirective(m *proto.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record := r.newRecord(RecordDirective, []byte(m.RawJSON))
+	for id, attach := range m.Attachments {
+		name := fmt.Sprintf("%d-%s.bin", record.Seq, filepath.Base(id))
+		tee := r.tee(attach, name)
+		if m.Attach == attach {
+			m.Attach = tee
+		}
+		m.Attachments[id] = tee
+		if record.Attachments == nil {
+			record.Attachments = make(map[string]string)
+		}
+		record.Attachments[id] = name
+	}
+	r.write(record)
+}
+
+func (r *Recorder) newRecord(kind string, message []byte) *Record {
+	r.seq++
+	if len(message) == 0 {
+		message = []byte("null")
+	}
+	return &Record{
+		Seq:     r.seq,
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: json.RawMessage(message),
+	}
+}
+
+func (r *Recorder) write(record *Record) {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("marshal record error:%s", err)
+		return
+	}
+	r.index.Write(append(buf, '\n'))
+}
+
+func (r *Recorder) tee(rc io.ReadCloser, name string) io.ReadCloser {
+	f, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		logger.Errorf("create attachment file error:%s", err)
+		return rc
+	}
+	return &teeReadCloser{
+		rc: rc,
+		f:  f,
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.index.Close()
+}
+
+// teeReadCloser 把读取的数据写入f，读到结尾或者Close的时候关闭f。
+// 原始的reader可能被别处关闭，例如语音输入结束的时候关闭录音流，这时候Read会返回io.EOF
+type teeReadCloser struct {
+	rc io.ReadCloser
+
+	mutex sync.Mutex
+	f     *os.File
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if n > 0 && t.f != nil {
+		t.f.Write(p[:n])
+	}
+	if err != nil {
+		t.closeFileLocked()
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) closeFileLocked() {
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
+
+// Close 同时关闭记录的文件和原始的reader
+func (t *teeReadCloser) Close() error {
+	t.mutex.Lock()
+	t.closeFileLocked()
+	t.mutex.Unlock()
+	return t.rc.Close()
+}
@@ -0,0 +1,218 @@
+package duer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/icexin/dueros/proto"
+)
+
+type fakeRegistry struct {
+	directives []*proto.Message
+	attaches   []string
+}
+
+func (f *fakeRegistry) Dispatch(m *proto.Message) error {
+	f.directives = append(f.directives, m)
+	if m.Attach != nil {
+		buf, _ := ioutil.ReadAll(m.Attach)
+		f.attaches = append(f.attaches, string(buf))
+	}
+	return nil
+}
+
+func (f *fakeRegistry) Context() []*proto.Message {
+	return nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dueros-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := proto.NewMessage(proto.NamespaceVoiceInput+".ListenStarted", &proto.ListenStartedPayload{})
+	event.Attach = ioutil.NopCloser(strings.NewReader("pcm"))
+	r.RecordEvent([]byte(`{"event":{}}`), event)
+	ioutil.ReadAll(event.Attach)
+	event.Attach.Close()
+
+	direct := &proto.Message{
+		RawJSON: `{"header":{"namespace":"ai.dueros.device_interface.voice_output","name":"Speak"},"payload":{"url":"cid:1"}}`,
+	}
+	direct.Attach = ioutil.NopCloser(strings.NewReader("mp3"))
+	direct.Attachments = map[string]io.ReadCloser{"1": direct.Attach}
+	r.RecordDirective(direct)
+	ioutil.ReadAll(direct.Attach)
+	direct.Attach.Close()
+	r.Close()
+
+	records, err := ReadArchive(r.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Kind != RecordEvent || records[1].Kind != RecordDirective {
+		t.Fatalf("bad records: %+v", records)
+	}
+	audio, _ := ioutil.ReadFile(filepath.Join(r.Dir(), records[0].Attachments["audio"]))
+	if string(audio) != "pcm" {
+		t.Errorf("expect pcm, got %s", audio)
+	}
+
+	registry := new(fakeRegistry)
+	d, err := newDuerOS(registry, "", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplayDirectives(r.Dir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.directives) != 1 {
+		t.Fatalf("expect 1 directive, got %d", len(registry.directives))
+	}
+	if _, ok := registry.directives[0].Payload.(*proto.SpeakPayload); !ok {
+		t.Errorf("expect *proto.SpeakPayload, got %T", registry.directives[0].Payload)
+	}
+	if len(registry.attaches) != 1 || registry.attaches[0] != "mp3" {
+		t.Errorf("bad attachments: %v", registry.attaches)
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestTeeClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dueros-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// 读到结尾的时候关闭文件，原始的reader由别处关闭
+	rc := &closeCounter{Reader: strings.NewReader("pcm")}
+	tee := r.tee(rc, "eof.pcm").(*teeReadCloser)
+	ioutil.ReadAll(tee)
+	if tee.f != nil {
+		t.Error("expect file closed at EOF")
+	}
+
+	// Close同时关闭文件和原始的reader
+	rc = &closeCounter{Reader: strings.NewReader("pcm")}
+	tee = r.tee(rc, "close.pcm").(*teeReadCloser)
+	tee.Close()
+	if tee.f != nil || rc.closed != 1 {
+		t.Errorf("expect both ends closed, file:%v, reader closed:%d", tee.f, rc.closed)
+	}
+}
+
+func TestRecordEventOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "dueros-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDuerOS(new(fakeRegistry), server.URL, Options{Recorder: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.skipAuth = true
+	event := proto.NewMessage(proto.NamespaceSystem+".SynchronizeState", &proto.SynchronizeStatePayload{})
+	// 第一次发送和重试
+	d.postEvent(event, true)
+	d.postEvent(event, false)
+	r.Close()
+
+	records, err := ReadArchive(r.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expect event recorded once, got %d records", len(records))
+	}
+}
+
+func TestReplayEventsLocal(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "dueros-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RecordEvent([]byte(`{"event":{}}`), proto.NewMessage(proto.NamespaceSystem+".SynchronizeState", nil))
+	r.Close()
+
+	// 测试环境没有token，本地的服务不需要授权
+	d, err := NewReplayOS(new(fakeRegistry), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplayEvents(r.Dir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 1 {
+		t.Errorf("expect 1 replayed request, got %d", requests)
+	}
+}
+
+func TestIsLocalEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		local    bool
+	}{
+		{"http://127.0.0.1:8081", true},
+		{"http://localhost:8081", true},
+		{"http://[::1]:8081", true},
+		{"https://dueros-h2.baidu.com", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isLocalEndpoint(c.endpoint); got != c.local {
+			t.Errorf("%q: expect %v, got %v", c.endpoint, c.local, got)
+		}
+	}
+}
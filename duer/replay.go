@@ -0,0 +1,157 @@
+package duer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+)
+
+// ReadArchive 读取Recorder生成的session目录中的所有记录
+func ReadArchive(dir string) ([]*Record, error) {
+	f, err := os.Open(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := new(Record)
+		err = json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func openAttachment(dir, name string) io.ReadCloser {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		logger.Errorf("open attachment error:%s", err)
+		return nil
+	}
+	return f
+}
+
+// directive 把记录还原成指令，附件从session目录中读取
+func (r *Record) directive(dir string) (*proto.Message, error) {
+	m := new(proto.Message)
+	err := json.Unmarshal(r.Message, m)
+	if err != nil {
+		return nil, err
+	}
+	m.RawJSON = string(r.Message)
+	for id, name := range r.Attachments {
+		attach := openAttachment(dir, name)
+		if attach == nil {
+			continue
+		}
+		if m.Attachments == nil {
+			m.Attachments = make(map[string]io.ReadCloser)
+		}
+		m.Attachments[id] = attach
+		if m.Attach == nil {
+			m.Attach = attach
+		}
+	}
+	return m, nil
+}
+
+// NewReplayOS 返回一个用于回放的DuerOS，不会建立下行通道。
+// endpoint为空的时候指令处理过程中产生的事件只打印日志，
+// 否则发送到endpoint，例如"http://127.0.0.1:8081"，本地的endpoint不需要授权
+func NewReplayOS(r Registry, endpoint string) (*DuerOS, error) {
+	d, err := newDuerOS(r, endpoint, Options{})
+	if err != nil {
+		return nil, err
+	}
+	d.skipAuth = isLocalEndpoint(endpoint)
+	go d.handleEventLoop()
+	return d, nil
+}
+
+// isLocalEndpoint 判断endpoint是否为本机的地址
+func isLocalEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// replay 按照记录的顺序回放kind类型的记录，realtime为true的时候保持原始的时间间隔
+func replay(dir, kind string, realtime bool, fn func(record *Record) error) error {
+	records, err := ReadArchive(dir)
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	for _, record := range records {
+		if record.Kind != kind {
+			continue
+		}
+		if realtime && !last.IsZero() {
+			time.Sleep(record.Time.Sub(last))
+		}
+		last = record.Time
+		err = fn(record)
+		if err != nil {
+			logger.Errorf("replay record %d error:%s", record.Seq, err)
+		}
+	}
+	return nil
+}
+
+// ReplayDirectives 把session中记录的指令按照顺序交给Registry处理
+func (d *DuerOS) ReplayDirectives(dir string, realtime bool) error {
+	return replay(dir, RecordDirective, realtime, func(record *Record) error {
+		direct, err := record.directive(dir)
+		if err != nil {
+			return err
+		}
+		logger.Message(direct).Infof("replay directive")
+		d.dispatch(direct)
+		return nil
+	})
+}
+
+// ReplayEvents 把session中记录的事件(包括当时的clientContext)重新发送到服务端，
+// 服务端返回的指令交给Registry处理
+func (d *DuerOS) ReplayEvents(dir string, realtime bool) error {
+	return replay(dir, RecordEvent, realtime, func(record *Record) error {
+		var attach io.ReadCloser
+		if name, ok := record.Attachments["audio"]; ok {
+			attach = openAttachment(dir, name)
+		}
+		if attach != nil {
+			defer attach.Close()
+		}
+		logger.Infof("replay event: %d", record.Seq)
+		resp, err := d.post(record.Message, attach)
+		if err == proto.ErrEmptyBody {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d.readResponse(resp, d.dispatch)
+		return nil
+	})
+}
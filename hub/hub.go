@@ -0,0 +1,138 @@
+// Package hub 把设备上发生的事情广播给订阅者，通过Handler以websocket推送给网页等客户端
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// 事件的类型
+const (
+	// TypeDirective 是收到的指令，Data为proto.Message
+	TypeDirective = "directive"
+	// TypeEvent 是发送给DuerOS的事件，Data为proto.Message
+	TypeEvent = "event"
+	// TypeConnection 是下行通道的连接状态，Data为Connection
+	TypeConnection = "connection"
+	// TypeDialogStart 是对话开始，Data为Dialog
+	TypeDialogStart = "dialogStart"
+	// TypeDialogEnd 是对话结束，Data为Dialog
+	TypeDialogEnd = "dialogEnd"
+	// TypeVoiceInputText 是语音识别的中间和最终结果，Data为proto.RenderVoiceInputTextPayload
+	TypeVoiceInputText = "voiceInputText"
+	// TypeRenderCard 是需要展示的卡片，Data为proto.RenderCardPayload
+	TypeRenderCard = "renderCard"
+	// TypePlayerInfo 是正在播放的音乐信息，Data为proto.RenderPlayerInfoPayload
+	TypePlayerInfo = "playerInfo"
+	// TypePlayerState 是播放状态的变化，Data为iface.PlayerStatus
+	TypePlayerState = "playerState"
+)
+
+// 对话结束的原因
+const (
+	DialogFinished    = "finished"
+	DialogInterrupted = "interrupted"
+)
+
+// 保留最后一个的事件类型，新的订阅者会先收到这些事件，用于客户端显示当前的状态
+var retainedTypes = map[string]bool{
+	TypeConnection:  true,
+	TypeRenderCard:  true,
+	TypePlayerInfo:  true,
+	TypePlayerState: true,
+}
+
+// 订阅者来不及接收的时候最多缓存的事件数，超过之后丢弃
+const subscriberBuffer = 64
+
+// Event 是广播的事件
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Connection 是TypeConnection的数据
+type Connection struct {
+	Connected bool `json:"connected"`
+}
+
+// Dialog 是TypeDialogStart和TypeDialogEnd的数据
+type Dialog struct {
+	DialogRequestId string `json:"dialogRequestId"`
+	// Reason 是对话结束的原因，DialogFinished或者DialogInterrupted
+	Reason string `json:"reason,omitempty"`
+}
+
+// Hub 把发布的事件广播给所有的订阅者
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]bool
+	retained    map[string]Event
+	order       []string
+}
+
+// DefaultHub 是Publish和Subscribe使用的Hub
+var DefaultHub = New()
+
+func New() *Hub {
+	return &Hub{
+		subscribers: make(map[chan Event]bool),
+		retained:    make(map[string]Event),
+	}
+}
+
+// Publish 广播事件，不会阻塞，订阅者的缓存满了之后事件被丢弃
+func (h *Hub) Publish(typ string, data interface{}) {
+	e := Event{
+		Type: typ,
+		Time: time.Now(),
+		Data: data,
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if retainedTypes[typ] {
+		if _, ok := h.retained[typ]; !ok {
+			h.order = append(h.order, typ)
+		}
+		h.retained[typ] = e
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe 返回接收事件的channel和取消订阅的函数，channel中首先是保留的最新状态
+func (h *Hub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	h.mutex.Lock()
+	for _, typ := range h.order {
+		ch <- h.retained[typ]
+	}
+	h.subscribers[ch] = true
+	h.mutex.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.mutex.Lock()
+			delete(h.subscribers, ch)
+			h.mutex.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Publish 通过DefaultHub广播事件
+func Publish(typ string, data interface{}) {
+	DefaultHub.Publish(typ, data)
+}
+
+// Subscribe 订阅DefaultHub
+func Subscribe() (<-chan Event, func()) {
+	return DefaultHub.Subscribe()
+}
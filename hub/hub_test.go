@@ -0,0 +1,237 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetained(t *testing.T) {
+	h := New()
+	h.Publish(TypeConnection, Connection{Connected: false})
+	h.Publish(TypeDirective, "ignored")
+	h.Publish(TypePlayerState, "PLAYING")
+	h.Publish(TypeConnection, Connection{Connected: true})
+
+	events, cancel := h.Subscribe()
+	defer cancel()
+	e := <-events
+	if e.Type != TypeConnection || !e.Data.(Connection).Connected {
+		t.Errorf("expect latest connection state, got %+v", e)
+	}
+	e = <-events
+	if e.Type != TypePlayerState {
+		t.Errorf("expect player state, got %+v", e)
+	}
+	select {
+	case e = <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	h := New()
+	events, cancel := h.Subscribe()
+	for i := 0; i < subscriberBuffer*2; i++ {
+		h.Publish(TypeDirective, i)
+	}
+	if len(events) != subscriberBuffer {
+		t.Errorf("expect %d buffered events, got %d", subscriberBuffer, len(events))
+	}
+	cancel()
+	cancel()
+	h.Publish(TypeDirective, "after cancel")
+	n := 0
+	for range events {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("expect %d events, got %d", subscriberBuffer, n)
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// RFC6455 1.3中的例子
+	key := acceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("bad accept key %s", key)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	h := New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, w, r)
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expect 400, got %d", resp.StatusCode)
+	}
+}
+
+// writeClientFrame 按照客户端的格式发送带掩码的帧
+func writeClientFrame(w io.Writer, opcode byte, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	buf := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	buf = append(buf, mask...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readServerFrame 读取服务端发送的不带掩码的帧
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var buf [2]byte
+		io.ReadFull(r, buf[:])
+		length = int(binary.BigEndian.Uint16(buf[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return header[0] & 0x0f, payload, err
+}
+
+func TestWebsocket(t *testing.T) {
+	h := New()
+	h.Publish(TypeConnection, Connection{Connected: true})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, w, r)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expect 101, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("bad accept header %s", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	// 连接之后首先收到保留的连接状态
+	opcode, payload, err := readServerFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e struct {
+		Type string
+		Data Connection
+	}
+	json.Unmarshal(payload, &e)
+	if opcode != opText || e.Type != TypeConnection || !e.Data.Connected {
+		t.Errorf("unexpected frame %d %s", opcode, payload)
+	}
+
+	h.Publish(TypeDialogStart, Dialog{DialogRequestId: strings.Repeat("x", 200)})
+	opcode, payload, err = readServerFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != opText || !strings.Contains(string(payload), `"type":"dialogStart"`) {
+		t.Errorf("unexpected frame %d %s", opcode, payload)
+	}
+
+	writeClientFrame(conn, opPing, []byte("hi"))
+	opcode, payload, err = readServerFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != opPong || string(payload) != "hi" {
+		t.Errorf("expect pong, got %d %s", opcode, payload)
+	}
+
+	writeClientFrame(conn, opClose, []byte{0x03, 0xe8})
+	opcode, _, err = readServerFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != opClose {
+		t.Errorf("expect close, got %d", opcode)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	AllowedOrigins = []string{"http://192.168.1.2:3000/"}
+	defer func() {
+		AllowedOrigins = nil
+	}()
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"http://pi.local:8080", true},
+		{"http://PI.local:8080", true},
+		{"http://192.168.1.2:3000", true},
+		{"http://evil.example.com", false},
+		{"http://pi.local:8081", false},
+		{"null", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://pi.local:8080/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := CheckOrigin(r); got != c.allowed {
+			t.Errorf("%q: expect %v, got %v", c.origin, c.allowed, got)
+		}
+	}
+}
+
+func TestCrossOriginWebsocket(t *testing.T) {
+	h := New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, w, r)
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Origin", "http://evil.example.com")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expect 403, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,273 @@
+package hub
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/logger"
+)
+
+// 这里只实现了推送事件需要的最小的websocket(RFC6455)服务端：
+// 发送不分片的文本帧，回复客户端的ping和close，忽略客户端发送的数据
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	// 客户端发送的帧的最大长度
+	maxFrameSize = 64 << 10
+	// 服务端发送ping的间隔，防止中间的代理关闭空闲的连接
+	pingInterval = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	errBadHandshake  = errors.New("bad websocket handshake")
+	errUnmaskedFrame = errors.New("websocket client frame not masked")
+	errFrameTooLarge = errors.New("websocket frame too large")
+)
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// ping的回复和推送的事件在不同的goroutine里面写入
+	mutex sync.Mutex
+}
+
+// acceptKey 根据客户端的Sec-WebSocket-Key计算Sec-WebSocket-Accept
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// AllowedOrigins 是除了和设备同一个host的网页之外，允许连接的网页的Origin，例如"http://192.168.1.2:3000"，
+// 需要在开始提供服务之前设置
+var AllowedOrigins []string
+
+// CheckOrigin 检查浏览器发起的请求是否来自设备自己的网页或者AllowedOrigins，
+// 防止其他网站的页面读取设备的事件或者控制设备。没有Origin的请求不是浏览器发起的，允许访问
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade 完成websocket握手，返回错误的时候还没有接管连接
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		return nil, errBadHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// writeFrame 发送一个完整的帧，服务端发送的帧不需要掩码
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var header [10]byte
+	header[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+		n += 8
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(append(header[:n], payload...))
+	return err
+}
+
+// readFrame 读取客户端的一个帧，客户端发送的帧必须带有掩码
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errUnmaskedFrame
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var buf [2]byte
+		_, err = io.ReadFull(c.r, buf[:])
+		length = uint64(binary.BigEndian.Uint16(buf[:]))
+	case 127:
+		var buf [8]byte
+		_, err = io.ReadFull(c.r, buf[:])
+		length = binary.BigEndian.Uint64(buf[:])
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxFrameSize {
+		return 0, nil, errFrameTooLarge
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.r, mask[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop 处理客户端的控制帧，直到客户端关闭连接
+func (c *wsConn) readLoop() error {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case opPing:
+			err = c.writeFrame(opPong, payload)
+		case opClose:
+			// 原样返回客户端的状态码，之后关闭连接
+			c.writeFrame(opClose, payload)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// Handler 把DefaultHub的事件以json文本帧推送给websocket客户端
+func Handler(w http.ResponseWriter, r *http.Request) {
+	serveWebsocket(DefaultHub, w, r)
+}
+
+func serveWebsocket(h *Hub, w http.ResponseWriter, r *http.Request) {
+	if !CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+	logger.Debugf("websocket client %s connected", r.RemoteAddr)
+
+	events, cancel := h.Subscribe()
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.readLoop()
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			buf, err := json.Marshal(e)
+			if err != nil {
+				logger.Errorf("marshal %s event error:%s", e.Type, err)
+				continue
+			}
+			err = conn.writeFrame(opText, buf)
+			if err != nil {
+				logger.Debugf("websocket client %s write error:%s", r.RemoteAddr, err)
+				return
+			}
+		case <-ticker.C:
+			err := conn.writeFrame(opPing, nil)
+			if err != nil {
+				return
+			}
+		case err := <-done:
+			logger.Debugf("websocket client %s disconnected:%v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
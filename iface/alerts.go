@@ -0,0 +1,343 @@
+package iface
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+)
+
+// DefaultAlertDuration 是闹钟响铃的最长时间
+const DefaultAlertDuration = time.Minute
+
+// ErrAlertNotFound 表示要删除的闹钟不存在
+var ErrAlertNotFound = errors.New("alert not found")
+
+// scheduledTime的格式，例如2017-08-15T15:00:00+0800
+var alertTimeLayouts = []string{"2006-01-02T15:04:05-0700", time.RFC3339}
+
+// sound 是一次响铃播放的声音，Close之后Play返回
+type sound interface {
+	Play() error
+	Close() error
+}
+
+type alert struct {
+	proto.Alert
+	at     time.Time
+	timer  *time.Timer
+	active bool
+	// 关闭的时候停止响铃
+	stop chan struct{}
+}
+
+// Alerts 是闹钟和提醒服务，到时间之后循环播放Sound
+type Alerts struct {
+	// Sound 是响铃播放的mp3
+	Sound string
+	// Duration 是响铃的最长时间，为0的时候使用DefaultAlertDuration
+	Duration time.Duration
+	// File 是保存闹钟的文件，重启之后通过Load恢复，为空的时候只保存在内存中
+	File string
+
+	p *audio.Player
+	// load 加载响铃的声音，测试的时候可以替换
+	load func(uri string) (sound, error)
+
+	mutex  sync.Mutex
+	alerts map[string]*alert
+
+	// 保证按照修改的顺序写入File
+	saveMutex sync.Mutex
+}
+
+func NewAlerts() *Alerts {
+	a := &Alerts{
+		Sound:  "resource/du.mp3",
+		p:      audio.NewPlayer(),
+		alerts: make(map[string]*alert),
+	}
+	a.load = a.loadSound
+	return a
+}
+
+func (a *Alerts) loadSound(uri string) (sound, error) {
+	w, err := a.p.LoadMP3(uri)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func parseScheduledTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range alertTimeLayouts {
+		var t time.Time
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (a *Alerts) SetAlert(m *proto.Message) error {
+	payload := m.Payload.(*proto.SetAlertPayload)
+	at, err := parseScheduledTime(payload.ScheduledTime)
+	if err != nil {
+		a.sendEvent("SetAlertFailed", payload.Token)
+		return err
+	}
+	// 已经过期的闹钟不再响铃
+	if !at.After(time.Now()) {
+		a.sendEvent("SetAlertFailed", payload.Token)
+		return fmt.Errorf("alert %s expired at %s", payload.Token, payload.ScheduledTime)
+	}
+	a.add(proto.Alert{
+		Token:         payload.Token,
+		Type:          payload.Type,
+		ScheduledTime: payload.ScheduledTime,
+	}, at)
+	a.save()
+	a.sendEvent("SetAlertSucceeded", payload.Token)
+	return nil
+}
+
+// add 添加或者替换闹钟，到时间之后响铃
+func (a *Alerts) add(p proto.Alert, at time.Time) {
+	al := &alert{
+		Alert: p,
+		at:    at,
+		stop:  make(chan struct{}),
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if prev, ok := a.alerts[al.Token]; ok {
+		a.removeLocked(prev)
+	}
+	a.alerts[al.Token] = al
+	al.timer = time.AfterFunc(time.Until(at), func() {
+		a.ring(al)
+	})
+}
+
+// Load 从File恢复上次运行时设置的闹钟，跳过已经过期的闹钟
+func (a *Alerts) Load() error {
+	if a.File == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(a.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var alerts []proto.Alert
+	err = json.Unmarshal(buf, &alerts)
+	if err != nil {
+		return fmt.Errorf("load alerts from %s: %s", a.File, err)
+	}
+	now := time.Now()
+	for _, p := range alerts {
+		at, err := parseScheduledTime(p.ScheduledTime)
+		if err != nil {
+			logger.Warnf("drop alert %s with bad scheduled time %s", p.Token, p.ScheduledTime)
+			continue
+		}
+		if !at.After(now) {
+			logger.Warnf("skip alert %s expired at %s", p.Token, p.ScheduledTime)
+			continue
+		}
+		a.add(p, at)
+	}
+	logger.Infof("load %d alerts from %s", len(a.List()), a.File)
+	a.save()
+	return nil
+}
+
+// save 把所有的闹钟写入File，失败的时候只记录日志
+func (a *Alerts) save() {
+	if a.File == "" {
+		return
+	}
+	a.saveMutex.Lock()
+	defer a.saveMutex.Unlock()
+	err := a.write()
+	if err != nil {
+		logger.Errorf("save alerts to %s error:%s", a.File, err)
+	}
+}
+
+func (a *Alerts) write() error {
+	buf, err := json.Marshal(a.List())
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(a.File), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := a.File + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.File)
+}
+
+func (a *Alerts) DeleteAlert(m *proto.Message) error {
+	token := m.Payload.(*proto.DeleteAlertPayload).Token
+	err := a.Delete(token)
+	if err == ErrAlertNotFound {
+		a.sendEvent("DeleteAlertFailed", token)
+		return nil
+	}
+	return err
+}
+
+// Delete 删除闹钟，正在响铃的闹钟会停止
+func (a *Alerts) Delete(token string) error {
+	a.mutex.Lock()
+	al, ok := a.alerts[token]
+	if ok {
+		a.removeLocked(al)
+	}
+	a.mutex.Unlock()
+	if !ok {
+		return ErrAlertNotFound
+	}
+	a.save()
+	a.sendEvent("DeleteAlertSucceeded", token)
+	return nil
+}
+
+// List 返回所有的闹钟，按照时间排序
+func (a *Alerts) List() []proto.Alert {
+	all, _ := a.snapshot()
+	return all
+}
+
+func (a *Alerts) snapshot() (all, active []proto.Alert) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var alerts []*alert
+	for _, al := range a.alerts {
+		alerts = append(alerts, al)
+	}
+	// 时间相同的闹钟按照token排序，保证顺序稳定
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].at.Equal(alerts[j].at) {
+			return alerts[i].Token < alerts[j].Token
+		}
+		return alerts[i].at.Before(alerts[j].at)
+	})
+	all, active = []proto.Alert{}, []proto.Alert{}
+	for _, al := range alerts {
+		all = append(all, al.Alert)
+		if al.active {
+			active = append(active, al.Alert)
+		}
+	}
+	return all, active
+}
+
+func (a *Alerts) removeLocked(al *alert) {
+	al.timer.Stop()
+	close(al.stop)
+	delete(a.alerts, al.Token)
+}
+
+// ring 循环播放Sound，直到闹钟被删除或者超过Duration
+func (a *Alerts) ring(al *alert) {
+	a.mutex.Lock()
+	if a.alerts[al.Token] != al {
+		a.mutex.Unlock()
+		return
+	}
+	al.active = true
+	a.mutex.Unlock()
+	a.sendEvent("AlertStarted", al.Token)
+
+	duration := a.Duration
+	if duration == 0 {
+		duration = DefaultAlertDuration
+	}
+	timeout := time.After(duration)
+	stopped := false
+	for !stopped {
+		w, err := a.load(a.Sound)
+		if err != nil {
+			logger.Errorf("load alert sound error:%s", err)
+			break
+		}
+		done := make(chan struct{})
+		go func() {
+			w.Play()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-al.stop:
+			stopped = true
+		case <-timeout:
+			stopped = true
+		}
+		w.Close()
+	}
+
+	a.mutex.Lock()
+	if a.alerts[al.Token] == al {
+		delete(a.alerts, al.Token)
+	}
+	a.mutex.Unlock()
+	a.save()
+	a.sendEvent("AlertStopped", al.Token)
+}
+
+// postEvent 把闹钟和音量的事件放入DuerOS的发送队列，没有启动DuerOS的时候丢弃，测试的时候可以替换
+var postEvent = func(m *proto.Message) {
+	if duer.OS == nil {
+		return
+	}
+	duer.OS.PostEvent(m)
+}
+
+func (a *Alerts) sendEvent(name, token string) {
+	postEvent(proto.NewMessage(proto.NamespaceAlerts+"."+name, &proto.AlertEventPayload{
+		Token: token,
+	}))
+}
+
+func (a *Alerts) Namespace() string {
+	return proto.NamespaceAlerts
+}
+
+func (a *Alerts) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"SetAlert":    a.SetAlert,
+		"DeleteAlert": a.DeleteAlert,
+	}
+}
+
+func (a *Alerts) Context() *proto.Message {
+	all, active := a.snapshot()
+	return proto.NewMessage(proto.NamespaceAlerts+".AlertsState", &proto.AlertsStatePayload{
+		AllAlerts:    all,
+		ActiveAlerts: active,
+	})
+}
+
+func init() {
+	Register(NewAlerts())
+}
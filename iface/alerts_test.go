@@ -0,0 +1,387 @@
+package iface
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icexin/dueros/proto"
+)
+
+// eventRecorder 替换postEvent，记录服务上报的事件
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func recordEvents() (*eventRecorder, func()) {
+	r := new(eventRecorder)
+	old := postEvent
+	postEvent = func(m *proto.Message) {
+		name := m.Header.Name
+		if p, ok := m.Payload.(*proto.AlertEventPayload); ok {
+			name += ":" + p.Token
+		}
+		r.mutex.Lock()
+		r.events = append(r.events, name)
+		r.mutex.Unlock()
+	}
+	return r, func() {
+		postEvent = old
+	}
+}
+
+func (r *eventRecorder) Events() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// waitEvent 等待事件出现，超时返回false
+func (r *eventRecorder) waitEvent(name string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, e := range r.Events() {
+			if e == name {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// directive 从json构造服务端下发的指令
+func directive(t *testing.T, name string, payload string) *proto.Message {
+	i := strings.LastIndex(name, ".")
+	raw := fmt.Sprintf(`{"header":{"namespace":%q,"name":%q,"messageId":"1"},"payload":%s}`,
+		name[:i], name[i+1:], payload)
+	m := new(proto.Message)
+	err := json.Unmarshal([]byte(raw), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// fakeSound 模拟响铃的声音，Play一直阻塞到Close
+type fakeSound struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *fakeSound) Play() error {
+	<-s.done
+	return nil
+}
+
+func (s *fakeSound) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// newTestAlerts 返回不播放声音的Alerts，响铃持续duration
+func newTestAlerts(duration time.Duration) *Alerts {
+	a := NewAlerts()
+	a.Duration = duration
+	a.load = func(uri string) (sound, error) {
+		return &fakeSound{done: make(chan struct{})}, nil
+	}
+	return a
+}
+
+func setAlertMessage(token string, at time.Time) *proto.Message {
+	return proto.NewMessage(proto.NamespaceAlerts+".SetAlert", &proto.SetAlertPayload{
+		Token:         token,
+		Type:          "ALARM",
+		ScheduledTime: at.Format(alertTimeLayouts[0]),
+	})
+}
+
+func TestSetAlert(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		token string
+		at    time.Time
+		ok    bool
+	}{
+		{"future", now.Add(time.Hour), true},
+		{"expired", now.Add(-time.Minute), false},
+		{"now", now.Add(-time.Second), false},
+	}
+	for _, c := range cases {
+		a := NewAlerts()
+		err := a.SetAlert(setAlertMessage(c.token, c.at))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expect ok %v, got %v", c.token, c.ok, err)
+		}
+		if n := len(a.List()); (n == 1) != c.ok {
+			t.Errorf("%s: unexpected %d alerts", c.token, n)
+		}
+		a.Delete(c.token)
+	}
+}
+
+func tokens(alerts []proto.Alert) []string {
+	var ret []string
+	for _, al := range alerts {
+		ret = append(ret, al.Token)
+	}
+	return ret
+}
+
+func TestAlertsPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "events", "alerts.state")
+
+	a := NewAlerts()
+	a.File = file
+	err = a.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.SetAlert(setAlertMessage("b", now.Add(2*time.Hour)))
+	a.SetAlert(setAlertMessage("a", now.Add(time.Hour)))
+	a.SetAlert(setAlertMessage("c", now.Add(3*time.Hour)))
+	a.Delete("c")
+	defer a.Delete("a")
+	defer a.Delete("b")
+
+	b := NewAlerts()
+	b.File = file
+	err = b.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete("a")
+	defer b.Delete("b")
+	if got := tokens(b.List()); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("expect alerts [a b], got %v", got)
+	}
+}
+
+func TestLoadExpiredAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.state")
+
+	// 设备关机期间过期的闹钟不会在启动的时候响铃
+	now := time.Now()
+	alerts := []proto.Alert{
+		{Token: "expired", Type: "ALARM", ScheduledTime: now.Add(-time.Hour).Format(alertTimeLayouts[0])},
+		{Token: "bad", Type: "ALARM", ScheduledTime: "tomorrow"},
+		{Token: "future", Type: "TIMER", ScheduledTime: now.Add(time.Hour).Format(alertTimeLayouts[0])},
+	}
+	buf, _ := json.Marshal(alerts)
+	ioutil.WriteFile(file, buf, 0644)
+
+	a := NewAlerts()
+	a.File = file
+	err = a.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Delete("future")
+	if got := tokens(a.List()); !reflect.DeepEqual(got, []string{"future"}) {
+		t.Errorf("expect alerts [future], got %v", got)
+	}
+
+	// 跳过的闹钟也从文件中删除
+	buf, _ = ioutil.ReadFile(file)
+	var saved []proto.Alert
+	json.Unmarshal(buf, &saved)
+	if got := tokens(saved); !reflect.DeepEqual(got, []string{"future"}) {
+		t.Errorf("expect saved alerts [future], got %v", got)
+	}
+}
+
+func TestLoadBadAlertsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.state")
+	ioutil.WriteFile(file, []byte("{"), 0644)
+
+	a := NewAlerts()
+	a.File = file
+	if err := a.Load(); err == nil {
+		t.Error("expect error loading bad alerts file")
+	}
+}
+
+// setTimer 设置d之后响铃的闹钟
+func setTimer(a *Alerts, token string, d time.Duration) error {
+	return a.SetAlert(proto.NewMessage(proto.NamespaceAlerts+".SetAlert", &proto.SetAlertPayload{
+		Token:         token,
+		Type:          "TIMER",
+		ScheduledTime: time.Now().Add(d).Format(time.RFC3339Nano),
+	}))
+}
+
+func TestAlertSchedule(t *testing.T) {
+	cases := []struct {
+		name     string
+		duration time.Duration
+		// 删除闹钟之前等待的事件，为空的时候不删除
+		deleteAfter string
+		events      []string
+	}{
+		// 超过Duration之后停止响铃
+		{"timeout", 100 * time.Millisecond, "", []string{
+			"SetAlertSucceeded:timeout", "AlertStarted:timeout", "AlertStopped:timeout"}},
+		// 到时间之前删除的闹钟不再响铃
+		{"deleted", time.Minute, "SetAlertSucceeded:deleted", []string{
+			"SetAlertSucceeded:deleted", "DeleteAlertSucceeded:deleted"}},
+		// 删除正在响铃的闹钟会停止响铃
+		{"stopped", time.Minute, "AlertStarted:stopped", []string{
+			"SetAlertSucceeded:stopped", "AlertStarted:stopped", "AlertStopped:stopped", "DeleteAlertSucceeded:stopped"}},
+	}
+	for _, c := range cases {
+		events, restore := recordEvents()
+		a := newTestAlerts(c.duration)
+		err := setTimer(a, c.name, 100*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.deleteAfter != "" {
+			if !events.waitEvent(c.deleteAfter, time.Second) {
+				t.Fatalf("%s: no event %s", c.name, c.deleteAfter)
+			}
+			a.Delete(c.name)
+		}
+		last := c.events[len(c.events)-1]
+		if !events.waitEvent(last, time.Second) {
+			t.Errorf("%s: no event %s", c.name, last)
+		}
+		// 等待被删除的闹钟的时间过去，确认没有多余的事件
+		time.Sleep(200 * time.Millisecond)
+		got := events.Events()
+		// 删除响铃的闹钟的时候DeleteAlertSucceeded和AlertStopped的顺序不确定
+		if len(got) > 2 {
+			sort.Strings(got[2:])
+		}
+		if !reflect.DeepEqual(got, c.events) {
+			t.Errorf("%s: expect events %v, got %v", c.name, c.events, got)
+		}
+		if n := len(a.List()); n != 0 {
+			t.Errorf("%s: expect no alerts left, got %d", c.name, n)
+		}
+		restore()
+	}
+}
+
+func TestAlertRestoreAndRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.state")
+
+	// 重启之前设置的闹钟在重启之后仍然会响铃
+	a := newTestAlerts(time.Minute)
+	a.File = file
+	err = setTimer(a, "restored", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟进程退出，旧的闹钟不再响铃
+	a.mutex.Lock()
+	for _, al := range a.alerts {
+		al.timer.Stop()
+	}
+	a.mutex.Unlock()
+
+	events, restore := recordEvents()
+	defer restore()
+	b := newTestAlerts(50 * time.Millisecond)
+	b.File = file
+	err = b.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokens(b.List()); !reflect.DeepEqual(got, []string{"restored"}) {
+		t.Fatalf("expect alerts [restored], got %v", got)
+	}
+	if !events.waitEvent("AlertStopped:restored", 2*time.Second) {
+		t.Fatalf("restored alert not rung, events %v", events.Events())
+	}
+	want := []string{"AlertStarted:restored", "AlertStopped:restored"}
+	if got := events.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect events %v, got %v", want, got)
+	}
+
+	// 响铃之后闹钟从文件中删除，再次重启不会重复响铃
+	buf, _ := ioutil.ReadFile(file)
+	var saved []proto.Alert
+	json.Unmarshal(buf, &saved)
+	if len(saved) != 0 {
+		t.Errorf("expect no saved alerts, got %v", tokens(saved))
+	}
+}
+
+func TestAlertDirectives(t *testing.T) {
+	at := time.Now().Add(time.Hour).Format(alertTimeLayouts[0])
+	setAlert := func(token string) string {
+		return fmt.Sprintf(`{"token":%q,"type":"ALARM","scheduledTime":%q}`, token, at)
+	}
+
+	cases := []struct {
+		name    string
+		payload string
+		ok      bool
+		alerts  []string
+		event   string
+	}{
+		{"SetAlert", setAlert("a"), true, []string{"a"}, "SetAlertSucceeded:a"},
+		{"SetAlert", setAlert("b"), true, []string{"a", "b"}, "SetAlertSucceeded:b"},
+		// 相同token的闹钟被替换
+		{"SetAlert", setAlert("a"), true, []string{"a", "b"}, "SetAlertSucceeded:a"},
+		{"SetAlert", `{"token":"c","type":"ALARM","scheduledTime":"tomorrow"}`, false, []string{"a", "b"}, "SetAlertFailed:c"},
+		{"DeleteAlert", `{"token":"a"}`, true, []string{"b"}, "DeleteAlertSucceeded:a"},
+		// 删除不存在的闹钟只上报失败事件
+		{"DeleteAlert", `{"token":"a"}`, true, []string{"b"}, "DeleteAlertFailed:a"},
+		{"DeleteAlert", `{"token":"b"}`, true, []string{}, "DeleteAlertSucceeded:b"},
+	}
+	events, restore := recordEvents()
+	defer restore()
+	r := new(Registry)
+	a := newTestAlerts(time.Minute)
+	err := r.Register(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cases {
+		err := r.Dispatch(directive(t, proto.NamespaceAlerts+"."+c.name, c.payload))
+		if (err == nil) != c.ok {
+			t.Errorf("%d %s: expect ok %v, got %v", i, c.name, c.ok, err)
+		}
+		if got := tokens(a.List()); len(got)+len(c.alerts) != 0 && !reflect.DeepEqual(got, c.alerts) {
+			t.Errorf("%d %s: expect alerts %v, got %v", i, c.name, c.alerts, got)
+		}
+		all := events.Events()
+		if got := all[len(all)-1]; got != c.event {
+			t.Errorf("%d %s: expect event %s, got %s", i, c.name, c.event, got)
+		}
+	}
+}
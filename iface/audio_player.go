@@ -1,12 +1,13 @@
 package iface
 
 import (
+	"sync"
 	"time"
 
 	"github.com/icexin/dueros/audio"
 	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/hub"
 	"github.com/icexin/dueros/proto"
-	"github.com/tidwall/gjson"
 )
 
 const (
@@ -17,9 +18,12 @@ const (
 )
 
 type AudioPlayer struct {
-	p             *audio.Player
+	p *audio.Player
+
+	// mutex保护下面的播放状态，保证Context拿到的是一致的快照
+	mutex         sync.Mutex
 	currWriter    *audio.Writer
-	currAudioItem gjson.Result
+	currAudioItem proto.AudioItem
 	state         string
 }
 
@@ -32,34 +36,47 @@ func NewAudioPlayer() *AudioPlayer {
 
 func (a *AudioPlayer) Play(m *proto.Message) error {
 	// 关闭前一个播放的音乐，同时等待结束
+	a.mutex.Lock()
 	a.state = AudioStateStoped
-	if a.currWriter != nil {
-		a.currWriter.Close()
-		a.currWriter.Wait()
+	prev := a.currWriter
+	a.mutex.Unlock()
+	if prev != nil {
+		prev.Close()
+		prev.Wait()
 	}
 
-	payload := &m.PayloadJSON
-	stream := payload.Get("audioItem.stream")
-	url := stream.Get("url").String()
-	token := stream.Get("token").String()
-	w, err := a.p.LoadMP3(url)
+	payload := m.Payload.(*proto.PlayPayload)
+	token := payload.AudioItem.Stream.Token
+	w, err := a.p.LoadMP3(payload.AudioItem.Stream.Url)
 	if err != nil {
 		return err
 	}
 
-	a.currWriter = w
-	err = a.currWriter.Start()
+	err = w.Start()
 	if err != nil {
 		return err
 	}
-	a.currAudioItem = payload.Get("audioItem")
+	a.mutex.Lock()
+	a.currWriter = w
+	a.currAudioItem = payload.AudioItem
+	a.state = AudioStatePlaying
+	a.publishLocked()
+	a.mutex.Unlock()
 	a.sendPlaybackStarted(token)
 
-	go a.reportProgress(w, m)
+	go a.reportProgress(w, &payload.AudioItem.Stream)
 	go func() {
 		w.Wait()
 		w.Close()
-		if a.state != AudioStateStoped {
+		a.mutex.Lock()
+		stopped := a.state == AudioStateStoped
+		// 已经开始播放下一首的时候不再修改状态
+		if a.currWriter == w {
+			a.state = AudioStateFinished
+			a.publishLocked()
+		}
+		a.mutex.Unlock()
+		if !stopped {
 			a.sendPlaybackNearlyFinished(token)
 		}
 		a.sendPlaybackFinished(token)
@@ -68,53 +85,86 @@ func (a *AudioPlayer) Play(m *proto.Message) error {
 }
 
 func (a *AudioPlayer) Stop(m *proto.Message) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	a.state = AudioStateStoped
 	if a.currWriter != nil {
 		a.currWriter.Close()
 	}
+	a.publishLocked()
 	return nil
 }
 
+// PlayerStatus 是音乐播放的状态
+type PlayerStatus struct {
+	State                string `json:"state"`
+	Token                string `json:"token"`
+	Url                  string `json:"url"`
+	OffsetInMilliseconds int64  `json:"offsetInMilliseconds"`
+}
+
+// Status 返回当前播放的状态和音乐
+func (a *AudioPlayer) Status() PlayerStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.statusLocked()
+}
+
+func (a *AudioPlayer) statusLocked() PlayerStatus {
+	status := PlayerStatus{
+		State: a.state,
+		Token: a.currAudioItem.Stream.Token,
+		Url:   a.currAudioItem.Stream.Url,
+	}
+	if a.currWriter != nil {
+		status.OffsetInMilliseconds = int64(a.currWriter.Offset() / time.Millisecond)
+	}
+	return status
+}
+
+// publishLocked 通知订阅者播放状态发生了变化
+func (a *AudioPlayer) publishLocked() {
+	hub.Publish(hub.TypePlayerState, a.statusLocked())
+}
+
 func (a *AudioPlayer) Context() *proto.Message {
-	token := a.currAudioItem.Get("stream.token").String()
-	var offset int32
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var offset int64
 	if a.currWriter != nil {
-		offset = int32(a.currWriter.Offset() / time.Millisecond)
+		offset = int64(a.currWriter.Offset() / time.Millisecond)
 	}
-	return proto.NewMessage("ai.dueros.device_interface.audio_player.PlaybackState", map[string]interface{}{
-		"token":                token,
-		"offsetInMilliseconds": offset,
-		"playerActivity":       a.state,
+	return proto.NewMessage(proto.NamespaceAudioPlayer+".PlaybackState", &proto.PlaybackStatePayload{
+		Token:                a.currAudioItem.Stream.Token,
+		OffsetInMilliseconds: offset,
+		PlayerActivity:       a.state,
 	})
 }
 
 func (a *AudioPlayer) sendPlaybackNearlyFinished(token string) {
-	duer.OS.PostEvent(proto.NewMessage("ai.dueros.device_interface.audio_player.PlaybackNearlyFinished", map[string]string{
-		"token": token,
+	duer.OS.PostEvent(proto.NewMessage(proto.NamespaceAudioPlayer+".PlaybackNearlyFinished", &proto.PlaybackEventPayload{
+		Token: token,
 	}))
 }
 
 func (a *AudioPlayer) sendPlaybackStarted(token string) {
-	a.state = AudioStatePlaying
-	duer.OS.PostEvent(proto.NewMessage("ai.dueros.device_interface.audio_player.PlaybackStarted", map[string]string{
-		"token": token,
+	duer.OS.PostEvent(proto.NewMessage(proto.NamespaceAudioPlayer+".PlaybackStarted", &proto.PlaybackEventPayload{
+		Token: token,
 	}))
 }
 
 func (a *AudioPlayer) sendPlaybackFinished(token string) {
-	a.state = AudioStateFinished
-	duer.OS.PostEvent(proto.NewMessage("ai.dueros.device_interface.audio_player.PlaybackFinished", map[string]string{
-		"token": token,
+	duer.OS.PostEvent(proto.NewMessage(proto.NamespaceAudioPlayer+".PlaybackFinished", &proto.PlaybackEventPayload{
+		Token: token,
 	}))
 }
 
-func (a *AudioPlayer) reportProgress(w *audio.Writer, m *proto.Message) {
-	stream := m.PayloadJSON.Get("audioItem.stream")
-	interval := stream.Get("progressReport.progressReportIntervalInMilliseconds").Int()
-	if interval == 0 {
+func (a *AudioPlayer) reportProgress(w *audio.Writer, stream *proto.Stream) {
+	if stream.ProgressReport == nil || stream.ProgressReport.ProgressReportIntervalInMilliseconds == 0 {
 		return
 	}
-	token := stream.Get("token").String()
+	interval := stream.ProgressReport.ProgressReportIntervalInMilliseconds
+	token := stream.Token
 
 	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
 	defer ticker.Stop()
@@ -122,31 +172,51 @@ func (a *AudioPlayer) reportProgress(w *audio.Writer, m *proto.Message) {
 		if w.Closed() {
 			break
 		}
-		duer.OS.PostEvent(proto.NewMessage("ai.dueros.device_interface.audio_player.ProgressReportIntervalElapsed", map[string]interface{}{
-			"token":                token,
-			"offsetInMilliseconds": w.Offset() / time.Millisecond,
+		duer.OS.PostEvent(proto.NewMessage(proto.NamespaceAudioPlayer+".ProgressReportIntervalElapsed", &proto.PlaybackEventPayload{
+			Token:                token,
+			OffsetInMilliseconds: int64(w.Offset() / time.Millisecond),
 		}))
 	}
 }
 
 func (a *AudioPlayer) Pause(m *proto.Message) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	a.state = AudioStatePaused
 	if a.currWriter != nil {
 		a.currWriter.Pause()
 	}
+	a.publishLocked()
 	return nil
 }
 
 func (a *AudioPlayer) Resume(m *proto.Message) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	if a.currWriter != nil {
 		a.state = AudioStatePlaying
 		a.currWriter.Resume()
+		a.publishLocked()
 		return nil
 	}
 	a.state = AudioStateStoped
+	a.publishLocked()
 	return nil
 }
 
+func (a *AudioPlayer) Namespace() string {
+	return proto.NamespaceAudioPlayer
+}
+
+func (a *AudioPlayer) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"Play":   a.Play,
+		"Stop":   a.Stop,
+		"Pause":  a.Pause,
+		"Resume": a.Resume,
+	}
+}
+
 func init() {
-	RegisterService(NewAudioPlayer(), "ai.dueros.device_interface.audio_player")
+	Register(NewAudioPlayer())
 }
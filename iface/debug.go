@@ -0,0 +1,19 @@
+package iface
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DebugContext 返回当前所有服务的状态，和发送事件时的clientContext一致
+func DebugContext(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(map[string]interface{}{
+		"clientContext": DefaultRegistry.Context(),
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
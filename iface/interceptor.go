@@ -0,0 +1,150 @@
+package iface
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnauthorized = errors.Wrap(proto.ErrUnsupportedDirective, "directive not authorized")
+)
+
+// HandlerFunc 处理一条指令
+type HandlerFunc func(m *proto.Message) error
+
+// Interceptor 在指令分发到具体的服务之前被调用，调用next继续处理，不调用则指令被拦截
+type Interceptor func(m *proto.Message, next HandlerFunc) error
+
+// ContextFunc 返回一个服务当前的状态
+type ContextFunc func() *proto.Message
+
+// ContextInterceptor 在获取namespace对应服务的状态的时候被调用，返回nil表示不上报该状态
+type ContextInterceptor func(namespace string, next ContextFunc) *proto.Message
+
+// Use 添加指令拦截器，先添加的先执行
+func (r *Registry) Use(interceptors ...Interceptor) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.interceptors = append(r.interceptors, interceptors...)
+}
+
+// UseContext 添加状态拦截器，先添加的先执行
+func (r *Registry) UseContext(interceptors ...ContextInterceptor) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.contextInterceptors = append(r.contextInterceptors, interceptors...)
+}
+
+func chainInterceptors(interceptors []Interceptor, h HandlerFunc) HandlerFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(m *proto.Message) error {
+			return interceptor(m, next)
+		}
+	}
+	return h
+}
+
+func chainContextInterceptors(interceptors []ContextInterceptor, namespace string, f ContextFunc) ContextFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], f
+		f = func() *proto.Message {
+			return interceptor(namespace, next)
+		}
+	}
+	return f
+}
+
+// LoggingInterceptor 记录每条指令的处理时间和错误
+func LoggingInterceptor(m *proto.Message, next HandlerFunc) error {
+	begin := time.Now()
+	err := next(m)
+	if err != nil {
+		logger.Message(m).Errorf("dispatch error:%s, cost %s", err, time.Since(begin))
+	} else {
+		logger.Message(m).Infof("dispatch cost %s", time.Since(begin))
+	}
+	return err
+}
+
+// RecoveryInterceptor 把处理指令过程中的panic转换成错误
+func RecoveryInterceptor(m *proto.Message, next HandlerFunc) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.Message(m).Errorf("panic while handling: %v\n%s", e, debug.Stack())
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	return next(m)
+}
+
+// RecoveryContextInterceptor 获取状态的时候发生panic则不上报该服务的状态
+func RecoveryContextInterceptor(namespace string, next ContextFunc) (m *proto.Message) {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.With(logger.F(logger.KeyNamespace, namespace)).Errorf("panic while getting context: %v\n%s", e, debug.Stack())
+			m = nil
+		}
+	}()
+	return next()
+}
+
+// ContextCache 在ttl时间内复用namespaces对应服务上一次的状态，适用于获取状态代价比较大的服务
+func ContextCache(ttl time.Duration, namespaces ...string) ContextInterceptor {
+	type entry struct {
+		m    *proto.Message
+		time time.Time
+	}
+	var (
+		mutex sync.Mutex
+		cache = make(map[string]*entry)
+	)
+	for _, namespace := range namespaces {
+		cache[namespace] = nil
+	}
+	return func(namespace string, next ContextFunc) *proto.Message {
+		mutex.Lock()
+		e, ok := cache[namespace]
+		mutex.Unlock()
+		if !ok {
+			return next()
+		}
+		if e != nil && time.Since(e.time) < ttl {
+			return e.m
+		}
+		m := next()
+		mutex.Lock()
+		cache[namespace] = &entry{m: m, time: time.Now()}
+		mutex.Unlock()
+		return m
+	}
+}
+
+// DialogFilter 丢弃不属于当前对话的指令，current返回当前对话的dialogRequestId，
+// 没有dialogRequestId的指令(例如下行通道的指令)不受影响
+func DialogFilter(current func() string) Interceptor {
+	return func(m *proto.Message, next HandlerFunc) error {
+		id := m.Header.DialogRequestId
+		if id != "" && id != current() {
+			logger.Message(m).Infof("drop directive of another dialog")
+			return nil
+		}
+		return next(m)
+	}
+}
+
+// NamespaceAuthorizer 只允许allow返回true的namespace的指令被处理
+func NamespaceAuthorizer(allow func(namespace string) bool) Interceptor {
+	return func(m *proto.Message, next HandlerFunc) error {
+		if !allow(m.Header.Namespace) {
+			return ErrUnauthorized
+		}
+		return next(m)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build noscreen
+// +build noscreen
+
+package iface
+
+import (
+	"testing"
+
+	"github.com/icexin/dueros/proto"
+)
+
+func TestNoScreenCapabilities(t *testing.T) {
+	interfaces := capabilityInterfaces()
+	for _, namespace := range []string{proto.NamespaceScreen, proto.NamespaceScreenExtendedCard} {
+		if interfaces[namespace] {
+			t.Errorf("%s should not be reported with noscreen tag", namespace)
+		}
+	}
+	if !interfaces[proto.NamespaceVoiceOutput] {
+		t.Errorf("expect %s in capabilities", proto.NamespaceVoiceOutput)
+	}
+}
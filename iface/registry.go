@@ -2,10 +2,19 @@ package iface
 
 import (
 	"fmt"
-	"log"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/icexin/dueros/logger"
 	"github.com/icexin/dueros/proto"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrServiceNotFound 表示namespace对应的服务没有注册
+	ErrServiceNotFound = errors.New("service not found")
 )
 
 var (
@@ -13,26 +22,123 @@ var (
 	typeOfMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
 )
 
+// Service 是显式声明了namespace、指令处理函数和状态的服务
+type Service interface {
+	// Namespace 返回服务的namespace，例如ai.dueros.device_interface.audio_player
+	Namespace() string
+	// Handlers 返回指令名字到处理函数的映射
+	Handlers() map[string]HandlerFunc
+	// Context 返回服务当前的状态，没有状态的服务返回nil
+	Context() *proto.Message
+}
+
 type service struct {
-	name    string        // name of service
-	rcvr    reflect.Value // receiver of methods for the service
-	methods map[string]*reflect.Method
+	name     string      // name of service
+	rcvr     interface{} // receiver of methods for the service
+	handlers map[string]HandlerFunc
+	context  ContextFunc
 }
 
 // Registry负责注册所有的用户接口对象，提供Dispatch方法来分发指令到具体的对象
 // 同时也提供Context方法返回当前所有对象的状态
+// 服务可以在运行时注册和注销，注册的服务发生变化的时候会通知OnChange注册的回调
 type Registry struct {
+	mutex    sync.RWMutex
 	services map[string]*service
+	// 注册过程中的错误，由Validate统一返回
+	errs []error
+
+	interceptors        []Interceptor
+	contextInterceptors []ContextInterceptor
+
+	listeners []func()
+
+	// 串行化Context的调用
+	contextMutex sync.Mutex
+}
+
+func (r *Registry) addError(err error) error {
+	r.mutex.Lock()
+	r.errs = append(r.errs, err)
+	r.mutex.Unlock()
+	return err
+}
+
+func (r *Registry) add(s *service) error {
+	r.mutex.Lock()
+	if r.services == nil {
+		r.services = make(map[string]*service)
+	} else if _, ok := r.services[s.name]; ok {
+		r.mutex.Unlock()
+		return r.addError(fmt.Errorf("service already defined: %q", s.name))
+	}
+	r.services[s.name] = s
+	r.mutex.Unlock()
+	r.notify()
+	return nil
+}
+
+// OnChange 注册服务发生变化时的回调
+func (r *Registry) OnChange(f func()) {
+	r.mutex.Lock()
+	r.listeners = append(r.listeners, f)
+	r.mutex.Unlock()
+}
+
+func (r *Registry) notify() {
+	r.mutex.RLock()
+	listeners := r.listeners
+	r.mutex.RUnlock()
+	for _, f := range listeners {
+		f()
+	}
+}
+
+// Unregister 注销namespace对应的服务，之后该namespace的指令不再被处理，状态也不再上报
+func (r *Registry) Unregister(namespace string) error {
+	r.mutex.Lock()
+	if _, ok := r.services[namespace]; !ok {
+		r.mutex.Unlock()
+		return fmt.Errorf("service not defined: %q", namespace)
+	}
+	delete(r.services, namespace)
+	r.mutex.Unlock()
+	r.notify()
+	return nil
+}
+
+// Capabilities 按照namespace的顺序返回所有注册服务支持的指令
+func (r *Registry) Capabilities() []proto.Capability {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var ret []proto.Capability
+	for _, s := range r.services {
+		c := proto.Capability{
+			Type:      "DuerOSInterface",
+			Interface: s.name,
+			Version:   "1.0",
+		}
+		for name := range s.handlers {
+			c.Directives = append(c.Directives, name)
+		}
+		sort.Strings(c.Directives)
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Interface < ret[j].Interface
+	})
+	return ret
 }
 
 // register adds a new service using reflection to extract its methods.
 func (r *Registry) register(rcvr interface{}, name string) error {
 	// Setup service.
 	s := &service{
-		name:    name,
-		rcvr:    reflect.ValueOf(rcvr),
-		methods: make(map[string]*reflect.Method),
+		name:     name,
+		rcvr:     rcvr,
+		handlers: make(map[string]HandlerFunc),
 	}
+	rcvrValue := reflect.ValueOf(rcvr)
 	rcvrType := reflect.TypeOf(rcvr)
 	// Setup methods.
 	for i := 0; i < rcvrType.NumMethod(); i++ {
@@ -42,99 +148,265 @@ func (r *Registry) register(rcvr interface{}, name string) error {
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs three ins: receiver, *Message
-		if mtype.NumIn() != 2 {
-			continue
-		}
-		// First argument must be a pointer and must be *Message.
-		ctxType := mtype.In(1)
-		if ctxType.Kind() != reflect.Ptr || ctxType.Elem() != typeOfMessage {
+		// Method without *Message argument is not a handler.
+		if !takesMessage(mtype) {
 			continue
 		}
-
-		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
+		// Method needs two ins: receiver, *Message, and one out: error.
+		if mtype.NumIn() != 2 || mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+			r.addError(fmt.Errorf("%s.%s takes *proto.Message but is not func(*proto.Message) error",
+				name, method.Name))
 			continue
 		}
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			continue
-		}
-		s.methods[method.Name] = &method
+		fn := rcvrValue.Method(i).Interface().(func(*proto.Message) error)
+		s.handlers[method.Name] = fn
 	}
-	if len(s.methods) == 0 {
-		return fmt.Errorf("%q has no exported methods of suitable type",
-			s.name)
+	if len(s.handlers) == 0 {
+		return r.addError(fmt.Errorf("%q has no exported methods of suitable type",
+			s.name))
 	}
-	if r.services == nil {
-		r.services = make(map[string]*service)
-	} else if _, ok := r.services[s.name]; ok {
-		return fmt.Errorf("service already defined: %q", s.name)
+	if c, ok := rcvr.(Contexter); ok {
+		s.context = c.Context
 	}
-	r.services[s.name] = s
-	return nil
+	return r.add(s)
+}
+
+func takesMessage(mtype reflect.Type) bool {
+	for i := 1; i < mtype.NumIn(); i++ {
+		in := mtype.In(i)
+		if in.Kind() == reflect.Ptr && in.Elem() == typeOfMessage {
+			return true
+		}
+	}
+	return false
 }
 
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
-func (r *Registry) get(namespace, name string) (*service, *reflect.Method, error) {
+func (r *Registry) get(namespace, name string) (*service, HandlerFunc, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	service := r.services[namespace]
 	if service == nil {
-		err := fmt.Errorf("can't find service %q", namespace)
+		err := errors.Wrapf(proto.ErrUnsupportedDirective, "can't find service %q", namespace)
 		return nil, nil, err
 	}
-	serviceMethod := service.methods[name]
-	if serviceMethod == nil {
-		err := fmt.Errorf("can't find method %q", name)
+	handler := service.handlers[name]
+	if handler == nil {
+		err := errors.Wrapf(proto.ErrUnsupportedDirective, "can't find method %q", name)
 		return nil, nil, err
 	}
-	return service, serviceMethod, nil
+	return service, handler, nil
 }
 
 func (r *Registry) getService(namespace string) *service {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	return r.services[namespace]
 }
 
+// RegisterService 通过反射注册receiver所有func(*proto.Message) error类型的导出方法
 func (r *Registry) RegisterService(receiver interface{}, name string) error {
 	return r.register(receiver, name)
 }
 
-func (r *Registry) Dispatch(m *proto.Message) error {
-	serviceSpec, methodSpec, err := r.get(m.Header.Namespace, m.Header.Name)
-	if err != nil {
-		log.Printf("unhandled message: %s.%s", m.Header.Namespace, m.Header.Name)
-		return err
+// Register 注册一个显式声明了指令处理函数的服务
+func (r *Registry) Register(svc Service) error {
+	s := &service{
+		name:     svc.Namespace(),
+		rcvr:     svc,
+		handlers: make(map[string]HandlerFunc),
+		context:  svc.Context,
 	}
+	for name, h := range svc.Handlers() {
+		if h == nil {
+			r.addError(fmt.Errorf("nil handler for %s.%s", s.name, name))
+			continue
+		}
+		s.handlers[name] = h
+	}
+	return r.add(s)
+}
 
-	retValue := methodSpec.Func.Call([]reflect.Value{
-		serviceSpec.rcvr,
-		reflect.ValueOf(m),
-	})
-	errInter := retValue[0].Interface()
-	if errInter != nil {
-		return errInter.(error)
+// Handle 注册namespace.name指令的处理函数，同一个指令只能注册一次
+func (r *Registry) Handle(namespace, name string, h HandlerFunc) error {
+	if h == nil {
+		return r.addError(fmt.Errorf("nil handler for %s.%s", namespace, name))
 	}
+	r.mutex.Lock()
+	if r.services == nil {
+		r.services = make(map[string]*service)
+	}
+	s := r.services[namespace]
+	if s == nil {
+		s = &service{
+			name:     namespace,
+			handlers: make(map[string]HandlerFunc),
+		}
+		r.services[namespace] = s
+	}
+	if _, ok := s.handlers[name]; ok {
+		r.mutex.Unlock()
+		return r.addError(fmt.Errorf("handler already defined: %s.%s", namespace, name))
+	}
+	s.handlers[name] = h
+	r.mutex.Unlock()
+	r.notify()
 	return nil
 }
 
+// Validate 返回注册过程中出现的所有错误，例如重复注册和签名错误的方法，应该在启动的时候调用
+func (r *Registry) Validate() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.errs) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, err := range r.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// sortedServices 返回按照namespace排序的所有服务
+func (r *Registry) sortedServices() []*service {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	services := make([]*service, 0, len(r.services))
+	for _, s := range r.services {
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].name < services[j].name
+	})
+	return services
+}
+
+// Dispatch 经过所有的拦截器之后把指令分发给对应的服务
+func (r *Registry) Dispatch(m *proto.Message) error {
+	r.mutex.RLock()
+	interceptors := r.interceptors
+	r.mutex.RUnlock()
+	return chainInterceptors(interceptors, r.dispatch)(m)
+}
+
+func (r *Registry) dispatch(m *proto.Message) error {
+	_, handler, err := r.get(m.Header.Namespace, m.Header.Name)
+	if err != nil {
+		logger.Message(m).Warnf("unhandled message")
+		return err
+	}
+	return handler(m)
+}
+
 type Contexter interface {
 	Context() *proto.Message
 }
 
+// Context 按照namespace的顺序返回所有服务的状态，同一时刻只会生成一份状态，
+// 每个服务需要保证自己的Context返回的是一致的快照
 func (r *Registry) Context() []*proto.Message {
+	r.contextMutex.Lock()
+	defer r.contextMutex.Unlock()
+
+	services := r.sortedServices()
+	r.mutex.RLock()
+	interceptors := r.contextInterceptors
+	r.mutex.RUnlock()
+
 	var ret []*proto.Message
-	for _, s := range r.services {
-		c, ok := s.rcvr.Interface().(Contexter)
-		if ok {
-			ret = append(ret, c.Context())
+	for _, s := range services {
+		if s.context == nil {
+			continue
+		}
+		m := chainContextInterceptors(interceptors, s.name, s.context)()
+		if m != nil {
+			ret = append(ret, m)
 		}
 	}
 	return ret
 }
 
-func (r *Registry) GetService(namespace string) interface{} {
+// LookupService 返回namespace对应的服务对象，没有注册或者只通过Handle注册的返回ErrServiceNotFound
+func (r *Registry) LookupService(namespace string) (interface{}, error) {
 	service := r.getService(namespace)
-	return service.rcvr.Interface()
+	if service == nil || service.rcvr == nil {
+		return nil, errors.Wrapf(ErrServiceNotFound, "%q", namespace)
+	}
+	return service.rcvr, nil
+}
+
+// GetService 返回namespace对应的服务对象，没有找到的时候返回nil
+func (r *Registry) GetService(namespace string) interface{} {
+	rcvr, _ := r.LookupService(namespace)
+	return rcvr
+}
+
+// AudioPlayer 返回注册的音乐播放服务
+func (r *Registry) AudioPlayer() (*AudioPlayer, error) {
+	rcvr, err := r.LookupService(proto.NamespaceAudioPlayer)
+	if err != nil {
+		return nil, err
+	}
+	player, ok := rcvr.(*AudioPlayer)
+	if !ok {
+		return nil, fmt.Errorf("%s is %T, not *AudioPlayer", proto.NamespaceAudioPlayer, rcvr)
+	}
+	return player, nil
+}
+
+// VoiceInput 返回注册的语音输入服务
+func (r *Registry) VoiceInput() (*VoiceInput, error) {
+	rcvr, err := r.LookupService(proto.NamespaceVoiceInput)
+	if err != nil {
+		return nil, err
+	}
+	input, ok := rcvr.(*VoiceInput)
+	if !ok {
+		return nil, fmt.Errorf("%s is %T, not *VoiceInput", proto.NamespaceVoiceInput, rcvr)
+	}
+	return input, nil
+}
+
+// VoiceOutput 返回注册的语音输出服务
+func (r *Registry) VoiceOutput() (*VoiceOutput, error) {
+	rcvr, err := r.LookupService(proto.NamespaceVoiceOutput)
+	if err != nil {
+		return nil, err
+	}
+	output, ok := rcvr.(*VoiceOutput)
+	if !ok {
+		return nil, fmt.Errorf("%s is %T, not *VoiceOutput", proto.NamespaceVoiceOutput, rcvr)
+	}
+	return output, nil
+}
+
+// SpeakerController 返回注册的音量控制服务
+func (r *Registry) SpeakerController() (*SpeakerController, error) {
+	rcvr, err := r.LookupService(proto.NamespaceSpeakerController)
+	if err != nil {
+		return nil, err
+	}
+	speaker, ok := rcvr.(*SpeakerController)
+	if !ok {
+		return nil, fmt.Errorf("%s is %T, not *SpeakerController", proto.NamespaceSpeakerController, rcvr)
+	}
+	return speaker, nil
+}
+
+// Alerts 返回注册的闹钟服务
+func (r *Registry) Alerts() (*Alerts, error) {
+	rcvr, err := r.LookupService(proto.NamespaceAlerts)
+	if err != nil {
+		return nil, err
+	}
+	alerts, ok := rcvr.(*Alerts)
+	if !ok {
+		return nil, fmt.Errorf("%s is %T, not *Alerts", proto.NamespaceAlerts, rcvr)
+	}
+	return alerts, nil
 }
 
 var (
@@ -146,3 +418,13 @@ var (
 func RegisterService(receiver interface{}, name string) error {
 	return DefaultRegistry.RegisterService(receiver, name)
 }
+
+// Register 注册服务到DefaultRegistry
+func Register(svc Service) error {
+	return DefaultRegistry.Register(svc)
+}
+
+// Handle 注册指令处理函数到DefaultRegistry
+func Handle(namespace, name string, h HandlerFunc) error {
+	return DefaultRegistry.Handle(namespace, name, h)
+}
@@ -0,0 +1,414 @@
+package iface
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icexin/dueros/proto"
+	"github.com/pkg/errors"
+)
+
+func nopHandler(m *proto.Message) error {
+	return nil
+}
+
+// testService 是显式声明指令处理函数的服务
+type testService struct {
+	namespace string
+	handlers  map[string]HandlerFunc
+	context   *proto.Message
+}
+
+func (s *testService) Namespace() string {
+	return s.namespace
+}
+
+func (s *testService) Handlers() map[string]HandlerFunc {
+	return s.handlers
+}
+
+func (s *testService) Context() *proto.Message {
+	return s.context
+}
+
+func newTestService(namespace string, names ...string) *testService {
+	s := &testService{
+		namespace: namespace,
+		handlers:  make(map[string]HandlerFunc),
+	}
+	for _, name := range names {
+		s.handlers[name] = nopHandler
+	}
+	return s
+}
+
+// badSignature 的Play方法接收*proto.Message但是没有返回error
+type badSignature struct{}
+
+func (b *badSignature) Play(m *proto.Message) {}
+
+func TestRegistration(t *testing.T) {
+	cases := []struct {
+		name     string
+		register func(r *Registry) error
+		// 注册的时候返回错误
+		fail bool
+		// Validate返回的错误中包含的内容，为空的时候Validate不返回错误
+		validate string
+	}{
+		{
+			name: "handle on zero registry",
+			register: func(r *Registry) error {
+				return r.Handle("foo", "Bar", nopHandler)
+			},
+		},
+		{
+			name: "register on zero registry",
+			register: func(r *Registry) error {
+				return r.Register(newTestService("foo", "Bar"))
+			},
+		},
+		{
+			name: "handle different directives",
+			register: func(r *Registry) error {
+				r.Handle("foo", "Bar", nopHandler)
+				return r.Handle("foo", "Baz", nopHandler)
+			},
+		},
+		{
+			name: "handle twice",
+			register: func(r *Registry) error {
+				r.Handle("foo", "Bar", nopHandler)
+				return r.Handle("foo", "Bar", nopHandler)
+			},
+			fail:     true,
+			validate: "handler already defined: foo.Bar",
+		},
+		{
+			name: "register twice",
+			register: func(r *Registry) error {
+				r.Register(newTestService("foo", "Bar"))
+				return r.Register(newTestService("foo", "Baz"))
+			},
+			fail:     true,
+			validate: `service already defined: "foo"`,
+		},
+		{
+			name: "handle nil",
+			register: func(r *Registry) error {
+				return r.Handle("foo", "Bar", nil)
+			},
+			fail:     true,
+			validate: "nil handler for foo.Bar",
+		},
+		{
+			name: "register nil handler",
+			register: func(r *Registry) error {
+				s := newTestService("foo", "Bar")
+				s.handlers["Baz"] = nil
+				return r.Register(s)
+			},
+			validate: "nil handler for foo.Baz",
+		},
+		{
+			name: "bad method signature",
+			register: func(r *Registry) error {
+				return r.RegisterService(new(badSignature), "foo")
+			},
+			fail:     true,
+			validate: "foo.Play takes *proto.Message but is not func(*proto.Message) error",
+		},
+	}
+	for _, c := range cases {
+		r := new(Registry)
+		err := c.register(r)
+		if (err != nil) != c.fail {
+			t.Errorf("%s: unexpected register error %v", c.name, err)
+		}
+		err = r.Validate()
+		if c.validate == "" && err != nil {
+			t.Errorf("%s: unexpected validate error %v", c.name, err)
+		}
+		if c.validate != "" && (err == nil || !strings.Contains(err.Error(), c.validate)) {
+			t.Errorf("%s: expect validate error %q, got %v", c.name, c.validate, err)
+		}
+	}
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Interceptor {
+		return func(m *proto.Message, next HandlerFunc) error {
+			calls = append(calls, name+" before")
+			err := next(m)
+			calls = append(calls, name+" after")
+			return err
+		}
+	}
+	r := new(Registry)
+	r.Handle("foo", "Bar", func(m *proto.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	r.Use(trace("first"))
+	r.Use(trace("second"))
+	err := r.Dispatch(proto.NewMessage("foo.Bar", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "first before,second before,handler,second after,first after"
+	if got := strings.Join(calls, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestContextInterceptorOrder(t *testing.T) {
+	var calls []string
+	r := new(Registry)
+	s := newTestService("foo", "Bar")
+	s.context = proto.NewMessage("foo.State", nil)
+	r.Register(s)
+	for _, name := range []string{"first", "second"} {
+		name := name
+		r.UseContext(func(namespace string, next ContextFunc) *proto.Message {
+			calls = append(calls, name+" "+namespace)
+			return next()
+		})
+	}
+	ctx := r.Context()
+	if len(ctx) != 1 {
+		t.Fatalf("expect 1 context, got %d", len(ctx))
+	}
+	if got := strings.Join(calls, ","); got != "first foo,second foo" {
+		t.Errorf("unexpected context interceptor order: %s", got)
+	}
+	// 返回nil的拦截器不上报状态
+	r.UseContext(func(namespace string, next ContextFunc) *proto.Message {
+		return nil
+	})
+	if ctx := r.Context(); len(ctx) != 0 {
+		t.Errorf("expect context dropped, got %d", len(ctx))
+	}
+}
+
+func TestDialogFilter(t *testing.T) {
+	cases := []struct {
+		dialogRequestId string
+		handled         bool
+	}{
+		{"current", true},
+		{"", true},
+		{"previous", false},
+	}
+	for _, c := range cases {
+		handled := false
+		r := new(Registry)
+		r.Handle("foo", "Bar", func(m *proto.Message) error {
+			handled = true
+			return nil
+		})
+		r.Use(DialogFilter(func() string {
+			return "current"
+		}))
+		m := proto.NewMessage("foo.Bar", nil)
+		m.Header.DialogRequestId = c.dialogRequestId
+		err := r.Dispatch(m)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.dialogRequestId, err)
+		}
+		if handled != c.handled {
+			t.Errorf("%q: expect handled %v, got %v", c.dialogRequestId, c.handled, handled)
+		}
+	}
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	r := new(Registry)
+	r.Handle("foo", "Bar", func(m *proto.Message) error {
+		panic("boom")
+	})
+	r.Use(RecoveryInterceptor)
+	err := r.Dispatch(proto.NewMessage("foo.Bar", nil))
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expect panic converted to error, got %v", err)
+	}
+}
+
+func TestUnregisterNotify(t *testing.T) {
+	r := new(Registry)
+	changes := 0
+	r.OnChange(func() {
+		changes++
+	})
+	r.Register(newTestService("foo", "Bar"))
+	r.Handle("baz", "Qux", nopHandler)
+	if changes != 2 {
+		t.Errorf("expect 2 changes after register, got %d", changes)
+	}
+	err := r.Unregister("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != 3 {
+		t.Errorf("expect 3 changes after unregister, got %d", changes)
+	}
+	// 注销之后的指令不再被处理
+	err = r.Dispatch(proto.NewMessage("foo.Bar", nil))
+	if errors.Cause(err) != proto.ErrUnsupportedDirective {
+		t.Errorf("expect unsupported directive, got %v", err)
+	}
+	if err := r.Unregister("foo"); err == nil {
+		t.Error("expect error on unregistering twice")
+	}
+	if changes != 3 {
+		t.Errorf("failed unregister should not notify, got %d changes", changes)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	r := new(Registry)
+	r.Register(newTestService("foo", "Stop", "Play"))
+	r.Handle("bar", "Speak", nopHandler)
+	caps := r.Capabilities()
+	if len(caps) != 2 {
+		t.Fatalf("expect 2 capabilities, got %d", len(caps))
+	}
+	if caps[0].Interface != "bar" || caps[1].Interface != "foo" {
+		t.Errorf("capabilities not sorted: %+v", caps)
+	}
+	if got := strings.Join(caps[1].Directives, ","); got != "Play,Stop" {
+		t.Errorf("directives not sorted: %s", got)
+	}
+}
+
+// capabilityInterfaces 返回DefaultRegistry声明的所有namespace
+func capabilityInterfaces() map[string]bool {
+	ret := make(map[string]bool)
+	for _, c := range DefaultRegistry.Capabilities() {
+		ret[c.Interface] = true
+	}
+	return ret
+}
+
+func TestLookupService(t *testing.T) {
+	r := new(Registry)
+	r.Handle(proto.NamespaceVoiceInput, "Listen", nopHandler)
+	r.Register(newTestService(proto.NamespaceAudioPlayer, "Play"))
+	player := NewAudioPlayer()
+	r2 := new(Registry)
+	r2.Register(player)
+
+	cases := []struct {
+		name   string
+		lookup func() (interface{}, error)
+		found  bool
+	}{
+		{"zero registry", func() (interface{}, error) {
+			return new(Registry).LookupService("foo")
+		}, false},
+		{"handle only", func() (interface{}, error) {
+			return r.LookupService(proto.NamespaceVoiceInput)
+		}, false},
+		{"registered", func() (interface{}, error) {
+			return r.LookupService(proto.NamespaceAudioPlayer)
+		}, true},
+		{"typed accessor on zero registry", func() (interface{}, error) {
+			return new(Registry).AudioPlayer()
+		}, false},
+		{"typed accessor with other type", func() (interface{}, error) {
+			return r.AudioPlayer()
+		}, false},
+		{"typed accessor", func() (interface{}, error) {
+			return r2.AudioPlayer()
+		}, true},
+	}
+	for _, c := range cases {
+		_, err := c.lookup()
+		if (err == nil) != c.found {
+			t.Errorf("%s: expect found %v, got error %v", c.name, c.found, err)
+		}
+	}
+	if _, err := r.LookupService("foo"); errors.Cause(err) != ErrServiceNotFound {
+		t.Errorf("expect ErrServiceNotFound, got %v", err)
+	}
+	if new(Registry).GetService("foo") != nil {
+		t.Error("expect nil service from zero registry")
+	}
+	if p, _ := r2.AudioPlayer(); p != player {
+		t.Error("typed accessor returns another player")
+	}
+}
+
+func TestContextOrder(t *testing.T) {
+	r := new(Registry)
+	for _, namespace := range []string{"c", "a", "b", "d"} {
+		s := newTestService(namespace, "Bar")
+		// 没有状态的服务不上报
+		if namespace != "d" {
+			s.context = proto.NewMessage(namespace+".State", nil)
+		}
+		r.Register(s)
+	}
+	for i := 0; i < 10; i++ {
+		var namespaces []string
+		for _, m := range r.Context() {
+			namespaces = append(namespaces, m.Header.Namespace)
+		}
+		if got := strings.Join(namespaces, ","); got != "a,b,c" {
+			t.Fatalf("expect a,b,c, got %s", got)
+		}
+	}
+}
+
+func TestContextCache(t *testing.T) {
+	calls := map[string]int{}
+	r := new(Registry)
+	for _, namespace := range []string{"cached", "fresh"} {
+		namespace := namespace
+		r.RegisterService(&contextCounter{
+			context: func() *proto.Message {
+				calls[namespace]++
+				return proto.NewMessage(namespace+".State", nil)
+			},
+		}, namespace)
+	}
+	r.UseContext(ContextCache(time.Hour, "cached"))
+	for i := 0; i < 3; i++ {
+		if ctx := r.Context(); len(ctx) != 2 {
+			t.Fatalf("expect 2 contexts, got %d", len(ctx))
+		}
+	}
+	if calls["cached"] != 1 || calls["fresh"] != 3 {
+		t.Errorf("unexpected context calls: %v", calls)
+	}
+
+	calls = map[string]int{}
+	r = new(Registry)
+	r.RegisterService(&contextCounter{
+		context: func() *proto.Message {
+			calls["expired"]++
+			return nil
+		},
+	}, "expired")
+	r.UseContext(ContextCache(time.Millisecond, "expired"))
+	r.Context()
+	time.Sleep(2 * time.Millisecond)
+	r.Context()
+	if calls["expired"] != 2 {
+		t.Errorf("expect cache expired, got %d calls", calls["expired"])
+	}
+}
+
+// contextCounter 是通过反射注册的服务，Context调用context
+type contextCounter struct {
+	context func() *proto.Message
+}
+
+func (c *contextCounter) Bar(m *proto.Message) error {
+	return nil
+}
+
+func (c *contextCounter) Context() *proto.Message {
+	return c.context()
+}
@@ -1,8 +1,12 @@
+//go:build !noscreen
+// +build !noscreen
+
 package iface
 
 import (
 	"fmt"
 
+	"github.com/icexin/dueros/hub"
 	"github.com/icexin/dueros/proto"
 )
 
@@ -10,14 +14,46 @@ type Screen struct {
 }
 
 func (s *Screen) RenderVoiceInputText(m *proto.Message) error {
-	fmt.Printf("\r>>> %-40s", m.PayloadJSON.Get("text"))
-	if m.PayloadJSON.Get("type").String() == "FINAL" {
+	payload := m.Payload.(*proto.RenderVoiceInputTextPayload)
+	hub.Publish(hub.TypeVoiceInputText, payload)
+	fmt.Printf("\r>>> %-40s", payload.Text)
+	if payload.Type == "FINAL" {
 		fmt.Println("\n>>> 倾听完毕")
 	}
 
 	return nil
 }
 
+func (s *Screen) RenderCard(m *proto.Message) error {
+	payload := m.Payload.(*proto.RenderCardPayload)
+	hub.Publish(hub.TypeRenderCard, payload)
+	if payload.Title != "" {
+		fmt.Printf(">>> %s\n", payload.Title)
+	}
+	if payload.Content != "" {
+		fmt.Printf(">>> %s\n", payload.Content)
+	}
+	for _, item := range payload.List {
+		fmt.Printf(">>> - %s %s\n", item.Title, item.Content)
+	}
+	return nil
+}
+
+func (s *Screen) Namespace() string {
+	return proto.NamespaceScreen
+}
+
+func (s *Screen) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"RenderVoiceInputText": s.RenderVoiceInputText,
+		"RenderCard":           s.RenderCard,
+	}
+}
+
+func (s *Screen) Context() *proto.Message {
+	return nil
+}
+
 func init() {
-	RegisterService(new(Screen), "ai.dueros.device_interface.screen")
+	Register(new(Screen))
 }
@@ -1,8 +1,12 @@
+//go:build !noscreen
+// +build !noscreen
+
 package iface
 
 import (
 	"fmt"
 
+	"github.com/icexin/dueros/hub"
 	"github.com/icexin/dueros/proto"
 )
 
@@ -10,12 +14,28 @@ type ScreenExtendedCard struct {
 }
 
 func (s *ScreenExtendedCard) RenderPlayerInfo(m *proto.Message) error {
-	content := m.PayloadJSON.Get("content")
-	fmt.Printf(">>> 正在播放 %s/%s/%s\n", content.Get("title"),
-		content.Get("titleSubtext1"), content.Get("titleSubtext2"))
+	payload := m.Payload.(*proto.RenderPlayerInfoPayload)
+	hub.Publish(hub.TypePlayerInfo, payload)
+	content := payload.Content
+	fmt.Printf(">>> 正在播放 %s/%s/%s\n", content.Title,
+		content.TitleSubtext1, content.TitleSubtext2)
+	return nil
+}
+
+func (s *ScreenExtendedCard) Namespace() string {
+	return proto.NamespaceScreenExtendedCard
+}
+
+func (s *ScreenExtendedCard) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"RenderPlayerInfo": s.RenderPlayerInfo,
+	}
+}
+
+func (s *ScreenExtendedCard) Context() *proto.Message {
 	return nil
 }
 
 func init() {
-	RegisterService(new(ScreenExtendedCard), "ai.dueros.device_interface.screen_extended_card")
+	Register(new(ScreenExtendedCard))
 }
@@ -0,0 +1,19 @@
+//go:build !noscreen
+// +build !noscreen
+
+package iface
+
+import (
+	"testing"
+
+	"github.com/icexin/dueros/proto"
+)
+
+func TestScreenCapabilities(t *testing.T) {
+	interfaces := capabilityInterfaces()
+	for _, namespace := range []string{proto.NamespaceScreen, proto.NamespaceScreenExtendedCard} {
+		if !interfaces[namespace] {
+			t.Errorf("expect %s in capabilities", namespace)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package iface
+
+import (
+	"sync"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/proto"
+)
+
+// SpeakerController 控制播放的音量，音量的范围为[0, 100]
+type SpeakerController struct {
+	mutex  sync.Mutex
+	volume int
+	muted  bool
+}
+
+// NewSpeakerController 创建音量控制服务，初始音量为100，即原始音量
+func NewSpeakerController() *SpeakerController {
+	return &SpeakerController{
+		volume: 100,
+	}
+}
+
+// Volume 返回当前的音量和是否静音
+func (s *SpeakerController) Volume() (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.volume, s.muted
+}
+
+// SetVolume 设置音量，超出范围的音量会被截断，设置之后上报VolumeChanged
+func (s *SpeakerController) SetVolume(volume int) {
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 100 {
+		volume = 100
+	}
+	s.mutex.Lock()
+	s.volume = volume
+	s.applyLocked()
+	s.mutex.Unlock()
+	s.sendState("VolumeChanged")
+}
+
+// SetMute 设置是否静音，设置之后上报MuteChanged
+func (s *SpeakerController) SetMute(muted bool) {
+	s.mutex.Lock()
+	s.muted = muted
+	s.applyLocked()
+	s.mutex.Unlock()
+	s.sendState("MuteChanged")
+}
+
+func (s *SpeakerController) applyLocked() {
+	if s.muted {
+		audio.SetGain(0)
+		return
+	}
+	// 人耳对音量的感知接近对数，用平方让音量的变化更均匀
+	v := float64(s.volume) / 100
+	audio.SetGain(v * v)
+}
+
+func (s *SpeakerController) state() *proto.VolumeStatePayload {
+	volume, muted := s.Volume()
+	return &proto.VolumeStatePayload{
+		Volume: volume,
+		Muted:  muted,
+	}
+}
+
+func (s *SpeakerController) sendState(name string) {
+	postEvent(proto.NewMessage(proto.NamespaceSpeakerController+"."+name, s.state()))
+}
+
+func (s *SpeakerController) handleSetVolume(m *proto.Message) error {
+	s.SetVolume(m.Payload.(*proto.SetVolumePayload).Volume)
+	return nil
+}
+
+func (s *SpeakerController) handleAdjustVolume(m *proto.Message) error {
+	volume, _ := s.Volume()
+	s.SetVolume(volume + m.Payload.(*proto.AdjustVolumePayload).Volume)
+	return nil
+}
+
+func (s *SpeakerController) handleSetMute(m *proto.Message) error {
+	s.SetMute(m.Payload.(*proto.SetMutePayload).Mute)
+	return nil
+}
+
+func (s *SpeakerController) Namespace() string {
+	return proto.NamespaceSpeakerController
+}
+
+func (s *SpeakerController) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"SetVolume":    s.handleSetVolume,
+		"AdjustVolume": s.handleAdjustVolume,
+		"SetMute":      s.handleSetMute,
+	}
+}
+
+func (s *SpeakerController) Context() *proto.Message {
+	return proto.NewMessage(proto.NamespaceSpeakerController+".VolumeState", s.state())
+}
+
+func init() {
+	Register(NewSpeakerController())
+}
@@ -0,0 +1,62 @@
+package iface
+
+import (
+	"math"
+	"testing"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/proto"
+)
+
+func TestSpeakerControllerDirectives(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		volume  int
+		muted   bool
+		gain    float64
+		event   string
+	}{
+		{"SetVolume", `{"volume":50}`, 50, false, 0.25, "VolumeChanged"},
+		{"AdjustVolume", `{"volume":-10}`, 40, false, 0.16, "VolumeChanged"},
+		// 超出范围的音量被截断
+		{"AdjustVolume", `{"volume":80}`, 100, false, 1, "VolumeChanged"},
+		{"SetVolume", `{"volume":-5}`, 0, false, 0, "VolumeChanged"},
+		{"SetVolume", `{"volume":30}`, 30, false, 0.09, "VolumeChanged"},
+		// 静音的时候保留音量，取消静音之后恢复
+		{"SetMute", `{"mute":true}`, 30, true, 0, "MuteChanged"},
+		{"AdjustVolume", `{"volume":20}`, 50, true, 0, "VolumeChanged"},
+		{"SetMute", `{"mute":false}`, 50, false, 0.25, "MuteChanged"},
+	}
+	events, restore := recordEvents()
+	defer restore()
+	defer audio.SetGain(1)
+	r := new(Registry)
+	s := NewSpeakerController()
+	err := r.Register(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cases {
+		err := r.Dispatch(directive(t, proto.NamespaceSpeakerController+"."+c.name, c.payload))
+		if err != nil {
+			t.Fatalf("%d %s: %v", i, c.name, err)
+		}
+		volume, muted := s.Volume()
+		if volume != c.volume || muted != c.muted {
+			t.Errorf("%d %s: expect volume %d muted %v, got %d %v", i, c.name, c.volume, c.muted, volume, muted)
+		}
+		if g := audio.Gain(); math.Abs(g-c.gain) > 1e-9 {
+			t.Errorf("%d %s: expect gain %v, got %v", i, c.name, c.gain, g)
+		}
+		all := events.Events()
+		if len(all) != i+1 || all[i] != c.event {
+			t.Errorf("%d %s: expect event %s, got %v", i, c.name, c.event, all)
+		}
+	}
+
+	state := s.Context().Payload.(*proto.VolumeStatePayload)
+	if state.Volume != 50 || state.Muted {
+		t.Errorf("unexpected volume state %+v", state)
+	}
+}
@@ -3,56 +3,190 @@ package iface
 import (
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/icexin/dueros/audio"
 	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/hub"
 	"github.com/icexin/dueros/proto"
 	uuid "github.com/satori/go.uuid"
 )
 
 type VoiceInput struct {
-	stream io.ReadCloser
+	// 用于查找可选依赖的服务，例如在倾听的时候暂停音乐
+	registry *Registry
+
+	// 唤醒可能发生在指令处理的过程中，mutex保护下面的字段
+	mutex           sync.Mutex
+	stream          io.ReadCloser
+	dialogRequestId string
+	// 当前的对话是否还没有结束
+	inDialog bool
+	// 收到StopListen的时间，用于统计从说完到开始播报的延迟
+	speechEnd time.Time
+}
+
+// NewVoiceInput 创建语音输入服务，r为nil的时候不依赖其他服务
+func NewVoiceInput(r *Registry) *VoiceInput {
+	return &VoiceInput{
+		registry: r,
+	}
 }
 
-func NewVoiceInput() *VoiceInput {
-	return &VoiceInput{}
+// ListenOptions 是一次倾听的参数
+type ListenOptions struct {
+	// 上传的录音从Position开始，用于把唤醒词之后紧接着说的话也发送出去
+	Position audio.Position
+	// 倾听方式，例如proto.ProfileFarField，为空的时候使用proto.ProfileNearField
+	Profile string
+	// 按住说话的时候Release在松开按键时被关闭，之后结束上传录音
+	Release <-chan struct{}
 }
 
 func (v *VoiceInput) Listen(m *proto.Message) error {
-	if v.stream != nil {
-		v.stream.Close()
+	return v.ListenWith(ListenOptions{
+		Position: audio.DefaultRecorder.Position(),
+	})
+}
+
+// ListenWith 按照opt开始倾听
+func (v *VoiceInput) ListenWith(opt ListenOptions) error {
+	if opt.Profile == "" {
+		opt.Profile = proto.ProfileNearField
 	}
 	v.slience()
 	fmt.Println(">>> 正在倾听")
-	v.stream = audio.NewRecordStream()
-	ctxid := uuid.NewV4().String()
-	message := proto.NewMessage("ai.dueros.device_interface.voice_input.ListenStarted", map[string]string{
-		"format": "AUDIO_L16_RATE_16000_CHANNELS_1",
+	stream := audio.NewRecordStreamAt(opt.Position)
+	ctxid := v.startDialog(stream)
+	message := proto.NewMessage(proto.NamespaceVoiceInput+".ListenStarted", &proto.ListenStartedPayload{
+		Format:  "AUDIO_L16_RATE_16000_CHANNELS_1",
+		Profile: opt.Profile,
 	})
 	message.Header.DialogRequestId = ctxid
-	message.Attach = v.stream
+	message.Attach = stream
+	if opt.Release != nil {
+		go func() {
+			<-opt.Release
+			stream.Stop()
+		}()
+	}
 	duer.OS.PostEvent(message)
 	return nil
 }
 
+// StartDialog 结束正在进行的倾听，开始一次新的对话并返回dialogRequestId，
+// 用于文本请求这类不需要录音的对话，之前对话的指令会被DialogFilter丢弃
+func (v *VoiceInput) StartDialog() string {
+	return v.startDialog(nil)
+}
+
+func (v *VoiceInput) startDialog(stream io.ReadCloser) string {
+	ctxid := uuid.NewV4().String()
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.stream != nil {
+		v.stream.Close()
+	}
+	if v.inDialog {
+		hub.Publish(hub.TypeDialogEnd, hub.Dialog{
+			DialogRequestId: v.dialogRequestId,
+			Reason:          hub.DialogInterrupted,
+		})
+	}
+	v.stream = stream
+	v.dialogRequestId = ctxid
+	v.inDialog = true
+	hub.Publish(hub.TypeDialogStart, hub.Dialog{DialogRequestId: ctxid})
+	return ctxid
+}
+
+// endDialog 在对话的语音播报完毕之后结束对话，id不是当前对话的时候忽略
+func (v *VoiceInput) endDialog(id string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if !v.inDialog || id != v.dialogRequestId {
+		return
+	}
+	v.inDialog = false
+	hub.Publish(hub.TypeDialogEnd, hub.Dialog{
+		DialogRequestId: id,
+		Reason:          hub.DialogFinished,
+	})
+}
+
+// Listening 返回是否正在上传录音，录音被StopListen关闭或者松开按键之后返回false
+func (v *VoiceInput) Listening() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	stream, ok := v.stream.(interface {
+		Ended() bool
+	})
+	return ok && !stream.Ended()
+}
+
+// DialogRequestId 返回当前对话的dialogRequestId
+func (v *VoiceInput) DialogRequestId() string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.dialogRequestId
+}
+
 func (v *VoiceInput) StopListen(m *proto.Message) error {
+	v.mutex.Lock()
 	if v.stream != nil {
 		v.stream.Close()
 	}
-	player := DefaultRegistry.GetService("ai.dueros.device_interface.audio_player").(*AudioPlayer)
-	if player != nil {
+	v.speechEnd = time.Now()
+	v.mutex.Unlock()
+	if player := v.audioPlayer(); player != nil {
 		player.Resume(nil)
 	}
 	return nil
 }
 
+// takeSpeechEnd 返回上一次倾听结束的时间并清空，没有的时候返回零值
+func (v *VoiceInput) takeSpeechEnd() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	t := v.speechEnd
+	v.speechEnd = time.Time{}
+	return t
+}
+
 func (v *VoiceInput) slience() {
-	player := DefaultRegistry.GetService("ai.dueros.device_interface.audio_player").(*AudioPlayer)
-	if player != nil {
+	if player := v.audioPlayer(); player != nil {
 		player.Pause(nil)
 	}
 }
 
+// audioPlayer 返回音乐播放服务，没有注册的时候返回nil
+func (v *VoiceInput) audioPlayer() *AudioPlayer {
+	if v.registry == nil {
+		return nil
+	}
+	player, err := v.registry.AudioPlayer()
+	if err != nil {
+		return nil
+	}
+	return player
+}
+
+func (v *VoiceInput) Namespace() string {
+	return proto.NamespaceVoiceInput
+}
+
+func (v *VoiceInput) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"Listen":     v.Listen,
+		"StopListen": v.StopListen,
+	}
+}
+
+func (v *VoiceInput) Context() *proto.Message {
+	return nil
+}
+
 func init() {
-	RegisterService(NewVoiceInput(), "ai.dueros.device_interface.voice_input")
+	Register(NewVoiceInput(DefaultRegistry))
 }
@@ -0,0 +1,39 @@
+package iface
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// endedStream 模拟录音流，ended表示录音是否已经结束
+type endedStream struct {
+	io.ReadCloser
+	ended bool
+}
+
+func (s *endedStream) Ended() bool {
+	return s.ended
+}
+
+func TestVoiceInputListening(t *testing.T) {
+	text := ioutil.NopCloser(strings.NewReader(""))
+	cases := []struct {
+		name   string
+		stream io.ReadCloser
+		want   bool
+	}{
+		{"idle", nil, false},
+		{"recording", &endedStream{ReadCloser: text}, true},
+		{"ended", &endedStream{ReadCloser: text, ended: true}, false},
+		{"text dialog", text, false},
+	}
+	for _, c := range cases {
+		v := NewVoiceInput(nil)
+		v.stream = c.stream
+		if got := v.Listening(); got != c.want {
+			t.Errorf("%s: Listening() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
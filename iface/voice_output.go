@@ -1,43 +1,149 @@
 package iface
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/metrics"
 	"github.com/icexin/dueros/proto"
 )
 
+var speechToTTS = metrics.NewHistogram("dueros_speech_to_tts_seconds",
+	"time from StopListen to the first audio of the following Speak", nil)
+
 type VoiceOutput struct {
 	p *audio.Player
+	// 用于查找可选依赖的服务，例如在播报的时候暂停音乐
+	registry *Registry
+
+	mutex sync.Mutex
+	// 正在播报的语音，Interrupt的时候被关闭
+	curr        *audio.Writer
+	interrupted bool
 }
 
-func NewVoiceOutput() *VoiceOutput {
+// NewVoiceOutput 创建语音输出服务，r为nil的时候不依赖其他服务
+func NewVoiceOutput(r *Registry) *VoiceOutput {
 	return &VoiceOutput{
-		p: audio.NewPlayer(),
+		p:        audio.NewPlayer(),
+		registry: r,
 	}
 }
 
 func (v *VoiceOutput) Speak(m *proto.Message) error {
+	if m.Attach == nil {
+		return errors.New("speak without audio attachment")
+	}
 	defer m.Attach.Close()
 	w, err := v.p.LoadMP3Reader(m.Attach)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
-	player := DefaultRegistry.GetService("ai.dueros.device_interface.audio_player").(*AudioPlayer)
-	if player != nil {
+	// LoadMP3Reader在第一帧数据到达之后返回
+	if end := v.speechEnd(); !end.IsZero() {
+		speechToTTS.Observe(time.Since(end).Seconds())
+	}
+	v.mutex.Lock()
+	v.curr = w
+	v.interrupted = false
+	v.mutex.Unlock()
+	defer func() {
+		v.mutex.Lock()
+		v.curr = nil
+		v.mutex.Unlock()
+	}()
+
+	if player := v.audioPlayer(); player != nil {
 		player.Pause(nil)
-		defer player.Resume(nil)
+		defer func() {
+			// 被打断的时候正在倾听，由StopListen恢复播放
+			if !v.isInterrupted() {
+				player.Resume(nil)
+			}
+		}()
 	}
 	err = w.Play()
 	if err != nil {
 		return err
 	}
+	if input := v.voiceInput(); input != nil && !v.isInterrupted() {
+		input.endDialog(m.Header.DialogRequestId)
+	}
 	return nil
 }
 
+// Interrupt 打断正在播报的语音，例如播报的时候被再次唤醒
+func (v *VoiceOutput) Interrupt() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.curr == nil {
+		return
+	}
+	v.interrupted = true
+	v.curr.Close()
+}
+
+func (v *VoiceOutput) isInterrupted() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.interrupted
+}
+
 func (v *VoiceOutput) Pause(m *proto.Message) error {
 	return nil
 }
 
+// speechEnd 返回语音输入服务上一次倾听结束的时间，只返回一次
+func (v *VoiceOutput) speechEnd() time.Time {
+	input := v.voiceInput()
+	if input == nil {
+		return time.Time{}
+	}
+	return input.takeSpeechEnd()
+}
+
+// voiceInput 返回语音输入服务，没有注册的时候返回nil
+func (v *VoiceOutput) voiceInput() *VoiceInput {
+	if v.registry == nil {
+		return nil
+	}
+	input, err := v.registry.VoiceInput()
+	if err != nil {
+		return nil
+	}
+	return input
+}
+
+// audioPlayer 返回音乐播放服务，没有注册的时候返回nil
+func (v *VoiceOutput) audioPlayer() *AudioPlayer {
+	if v.registry == nil {
+		return nil
+	}
+	player, err := v.registry.AudioPlayer()
+	if err != nil {
+		return nil
+	}
+	return player
+}
+
+func (v *VoiceOutput) Namespace() string {
+	return proto.NamespaceVoiceOutput
+}
+
+func (v *VoiceOutput) Handlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"Speak": v.Speak,
+		"Pause": v.Pause,
+	}
+}
+
+func (v *VoiceOutput) Context() *proto.Message {
+	return nil
+}
+
 func init() {
-	RegisterService(NewVoiceOutput(), "ai.dueros.device_interface.voice_output")
+	Register(NewVoiceOutput(DefaultRegistry))
 }
@@ -0,0 +1,189 @@
+// Package logger 是duer、auth、iface和audio使用的分级结构化日志
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icexin/dueros/proto"
+)
+
+// Level 是日志的级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel 解析debug、info、warn、error，不区分大小写
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// 常用的字段名
+const (
+	KeyNamespace       = "namespace"
+	KeyName            = "name"
+	KeyMessageID       = "messageId"
+	KeyDialogRequestID = "dialogRequestId"
+)
+
+// Field 是日志中的一个key=value字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F 返回一个字段
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger 是日志的接口，With返回带有额外字段的Logger
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	With(fields ...Field) Logger
+}
+
+var (
+	mutex  sync.RWMutex
+	output io.Writer = os.Stderr
+	level            = LevelInfo
+	std    Logger    = &stdLogger{}
+)
+
+// SetOutput 设置默认Logger的输出，例如RotateWriter
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	output = w
+	mutex.Unlock()
+}
+
+// SetLevel 设置默认Logger输出的最低级别
+func SetLevel(l Level) {
+	mutex.Lock()
+	level = l
+	mutex.Unlock()
+}
+
+// SetLogger 替换包级别函数使用的Logger
+func SetLogger(l Logger) {
+	mutex.Lock()
+	std = l
+	mutex.Unlock()
+}
+
+func current() Logger {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return std
+}
+
+func Debugf(format string, args ...interface{}) { current().Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { current().Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { current().Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { current().Errorf(format, args...) }
+
+// With 返回带有fields的Logger
+func With(fields ...Field) Logger {
+	return current().With(fields...)
+}
+
+// Message 返回带有消息头中namespace、name、messageId和dialogRequestId字段的Logger
+func Message(m *proto.Message) Logger {
+	h := m.Header
+	fields := []Field{F(KeyNamespace, h.Namespace), F(KeyName, h.Name)}
+	if h.MessageId != "" {
+		fields = append(fields, F(KeyMessageID, h.MessageId))
+	}
+	if h.DialogRequestId != "" {
+		fields = append(fields, F(KeyDialogRequestID, h.DialogRequestId))
+	}
+	return With(fields...)
+}
+
+// stdLogger 是默认的实现，每条日志一行：时间 级别 文件:行号: 内容 key=value...，token会被隐去
+type stdLogger struct {
+	fields []Field
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+func (l *stdLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args) }
+func (l *stdLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args) }
+func (l *stdLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
+
+func (l *stdLogger) With(fields ...Field) Logger {
+	n := &stdLogger{fields: make([]Field, 0, len(l.fields)+len(fields))}
+	n.fields = append(n.fields, l.fields...)
+	n.fields = append(n.fields, fields...)
+	return n
+}
+
+func (l *stdLogger) logf(lv Level, format string, args []interface{}) {
+	mutex.RLock()
+	w, min := output, level
+	mutex.RUnlock()
+	if lv < min {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+	fmt.Fprintf(buf, "%-5s %s: ", lv, caller())
+	buf.WriteString(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	for _, f := range l.fields {
+		fmt.Fprintf(buf, " %s=%v", f.Key, f.Value)
+	}
+	buf.WriteByte('\n')
+	w.Write([]byte(Redact(buf.String())))
+}
+
+// pkgPrefix 是这个包中函数名的前缀，用于跳过日志函数找到调用者
+var pkgPrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+strings.Index(name[slash:], ".")+1]
+}()
+
+func caller() string {
+	pcs := make([]uintptr, 8)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, pkgPrefix) {
+			return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return "???:0"
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package logger_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
+)
+
+func TestLevelAndFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger.SetOutput(buf)
+	logger.SetLevel(logger.LevelInfo)
+	defer logger.SetOutput(os.Stderr)
+
+	logger.Debugf("hidden")
+	m := proto.NewMessage(proto.NamespaceVoiceInput+".ListenStarted", &proto.ListenStartedPayload{})
+	m.Header.DialogRequestId = "d1"
+	logger.Message(m).With(logger.F("cost", "1s")).Warnf("post event error:%s", "eof")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expect 1 line, got %q", buf.String())
+	}
+	line := lines[0]
+	for _, s := range []string{
+		"WARN",
+		"logger_test.go:",
+		"post event error:eof",
+		"namespace=" + proto.NamespaceVoiceInput,
+		"name=ListenStarted",
+		"messageId=" + m.Header.MessageId,
+		"dialogRequestId=d1",
+		"cost=1s",
+	} {
+		if !strings.Contains(line, s) {
+			t.Errorf("expect %q in %q", s, line)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{`{"access_token":"abc","expires_in":10}`, `{"access_token":"***","expires_in":10}`},
+		{`Get https://x/token?client_secret=s1&refresh_token=r1&scope=basic: EOF`, `Get https://x/token?client_secret=***&refresh_token=***&scope=basic: EOF`},
+		{`authorization: Bearer abc.def`, `authorization: Bearer ***`},
+		{`nothing secret`, `nothing secret`},
+	}
+	for _, c := range cases {
+		if got := logger.Redact(c.in); got != c.out {
+			t.Errorf("Redact(%q) = %q, expect %q", c.in, got, c.out)
+		}
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dueros-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "duer.log")
+	w, err := logger.NewRotateWriter(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		w.Write([]byte(s))
+	}
+
+	expect := map[string]string{
+		name:        "dddddd\n",
+		name + ".1": "cccccc\n",
+		name + ".2": "bbbbbb\n",
+	}
+	for file, content := range expect {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != content {
+			t.Errorf("expect %q in %s, got %q", content, file, buf)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expect at most 2 backups")
+	}
+}
@@ -0,0 +1,18 @@
+package logger
+
+import "regexp"
+
+var redactPatterns = []*regexp.Regexp{
+	// json、表单和url中的token和secret，例如"access_token":"xxx"、refresh_token=xxx
+	regexp.MustCompile(`((?:access_token|refresh_token|client_secret)"?\s*[:=]\s*"?)[^"&\s,}]+`),
+	// http头，例如authorization: Bearer xxx
+	regexp.MustCompile(`((?i:bearer)\s+)[^"\s,}]+`),
+}
+
+// Redact 隐去s中的access token、refresh token和client secret
+func Redact(s string) string {
+	for _, re := range redactPatterns {
+		s = re.ReplaceAllString(s, "${1}***")
+	}
+	return s
+}
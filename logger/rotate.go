@@ -0,0 +1,94 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotateWriter 写入文件，文件超过MaxSize之后重命名为file.1，原来的file.1重命名为file.2，
+// 最多保留MaxBackups个旧文件
+type RotateWriter struct {
+	Filename   string
+	MaxSize    int64
+	MaxBackups int
+
+	mutex sync.Mutex
+	f     *os.File
+	size  int64
+}
+
+// NewRotateWriter 打开filename，maxSize为0的时候不切分
+func NewRotateWriter(filename string, maxSize int64, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	f, err := os.OpenFile(w.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.MaxSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", w.Filename, i)
+	}
+	if w.MaxBackups > 0 {
+		os.Remove(backup(w.MaxBackups))
+		for i := w.MaxBackups - 1; i > 0; i-- {
+			os.Rename(backup(i), backup(i+1))
+		}
+		os.Rename(w.Filename, backup(1))
+	} else {
+		os.Remove(w.Filename)
+	}
+	return w.open()
+}
+
+func (w *RotateWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
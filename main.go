@@ -1,44 +1,100 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/icexin/dueros/audio"
 	"github.com/icexin/dueros/auth"
 	"github.com/icexin/dueros/duer"
+	"github.com/icexin/dueros/hub"
 	"github.com/icexin/dueros/iface"
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/metrics"
 )
 
 var (
-	wakeupMethod = flag.String("wakeup", "keyword", "wakeup method(keyboard|keyword)")
+	wakeupMethod = flag.String("wakeup", "keyword", "wakeup method(keyboard|keyword|evdev|gpio|http|signal), comma separated to use several at once")
+	preroll      = flag.Duration("preroll", 0, "start recognition this long before the wakeup word ends")
+	echoCancel   = flag.Bool("aec", false, "cancel the echo of playback from the microphone")
+	echoDelay    = flag.Duration("aec_delay", 0, "delay of the playback echo in the recording, 0 to estimate from the device latencies")
+
+	recordDir      = flag.String("record_dir", "", "record events and directives of this session into dir")
+	replayServer   = flag.String("replay_server", "", "re-post recorded events to this endpoint instead of dispatching recorded directives")
+	replayRealtime = flag.Bool("replay_realtime", false, "keep the recorded interval between messages when replaying")
+
+	eventQueueDir  = flag.String("event_queue_dir", "events", "dir to persist undelivered events, empty to keep them in memory")
+	eventQueueSize = flag.Int("event_queue_size", duer.DefaultQueueSize, "max number of undelivered events")
+	eventTTL       = flag.Duration("event_ttl", duer.DefaultEventTTL, "drop undelivered events older than this")
+
+	printCapabilities = flag.Bool("capabilities", false, "print capabilities of registered services and exit")
+
+	endpoint    = flag.String("endpoint", "", "endpoint of dueros server, default https://"+duer.DuerOSHost)
+	deviceID    = flag.String("device_id", "", "device id reported to dueros, default a random id per run")
+	audioIn     = flag.String("audio_in", "", "input audio device, index, name or part of name, default the default device")
+	audioOut    = flag.String("audio_out", audio.OutputDevice, "output audio device, index, name or part of name, default the DUEROS_OUT env or the default device")
+	httpAddr    = flag.String("http_addr", "127.0.0.1:8080", "listen address of the http server, :8080 to allow other hosts")
+	logFile     = flag.String("log_file", "duer.log", "log file")
+	logLevel    = flag.String("log_level", "info", "log level(debug|info|warn|error), debug logs full request json")
+	logMaxSize  = flag.Int("log_max_size", 10, "rotate the log file after this many megabytes, 0 to never rotate")
+	logBackups  = flag.Int("log_max_backups", 3, "number of rotated log files to keep")
+	wakeupSound = flag.String("wakeup_sound", "resource/du.mp3", "sound played after wakeup")
+	alertSound  = flag.String("alert_sound", "resource/du.mp3", "sound played repeatedly when an alert goes off")
+
+	allowedOrigins = flag.String("allowed_origins", "", "comma separated origins of other web pages allowed to use /ws, e.g. http://192.168.1.2:3000")
 )
 
 func setuplog() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	f, err := os.OpenFile("duer.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	level, err := logger.ParseLevel(*logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.SetOutput(f)
+	w, err := logger.NewRotateWriter(*logFile, int64(*logMaxSize)<<20, *logBackups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.SetLevel(level)
+	logger.SetOutput(w)
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetOutput(w)
 }
 
+// setuphttp 注册公共的调试接口和事件推送并启动http服务
 func setuphttp() {
+	hub.AllowedOrigins = splitList(*allowedOrigins)
+	http.HandleFunc("/debug/context", iface.DebugContext)
+	http.HandleFunc("/metrics", metrics.Handler)
+	http.HandleFunc("/ws", hub.Handler)
+	http.HandleFunc("/wakeup", handleWakeup)
 	go func() {
-		log.Fatal(http.ListenAndServe(":8080", nil))
+		log.Fatal(http.ListenAndServe(*httpAddr, nil))
 	}()
 }
 
+// splitList 拆分逗号分隔的列表，忽略空白的项
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
 func waitToken() {
 	_, err := auth.GetToken()
 	if err == nil {
 		return
 	}
-	fmt.Println("open browser, type: http://pi.local:8080/login")
+	fmt.Printf("open browser, type: %s\n", auth.LoginURL())
 	ticker := time.NewTicker(time.Second * 3)
 	defer ticker.Stop()
 	for range ticker.C {
@@ -49,22 +105,48 @@ func waitToken() {
 	}
 }
 
+func duerOptions() duer.Options {
+	return duer.Options{
+		Endpoint:  *endpoint,
+		DeviceID:  *deviceID,
+		QueueDir:  *eventQueueDir,
+		QueueSize: *eventQueueSize,
+		EventTTL:  *eventTTL,
+	}
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	if *configFile != "" {
+		err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	audio.InputDevice = *audioIn
+	audio.OutputDevice = *audioOut
+
+	name, cmd, args, err := parseCommand(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
 
 	setuplog()
-	setuphttp()
-	// 等待access token被设置好
-	waitToken()
-
-	duer.OS = duer.NewDuerOS(iface.DefaultRegistry)
-	wakeup := NewWakeupListener(*wakeupMethod)
-	player := audio.NewPlayer()
-	voiceInput := iface.DefaultRegistry.GetService("ai.dueros.device_interface.voice_input").(*iface.VoiceInput)
-	for {
-		fmt.Println(">>> 等待唤醒")
-		wakeup.ListenAndWakeup()
-		player.LoadAndPlay("resource/du.mp3")
-		voiceInput.Listen(nil)
+	err = iface.DefaultRegistry.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printCapabilities {
+		buf, _ := json.MarshalIndent(iface.DefaultRegistry.Capabilities(), "", "  ")
+		fmt.Println(string(buf))
+		return
+	}
+	err = cmd.run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,215 @@
+// Package metrics 实现计数器和直方图，通过Handler以prometheus的文本格式输出
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets 是直方图默认的分桶，单位为秒
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric 是可以输出到/metrics的指标
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	mutex   sync.Mutex
+	metrics = make(map[string]metric)
+)
+
+func register(m metric) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := metrics[m.name()]; ok {
+		panic("duplicate metric " + m.name())
+	}
+	metrics[m.name()] = m
+}
+
+// Counter 是只增不减的计数器，可以带有标签
+type Counter struct {
+	metricName string
+	help       string
+	labels     []string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter 创建并注册一个计数器，Inc和Add的时候需要按照labels的顺序传入标签的值
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		values:     make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+// Inc 计数加一
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add 计数加v，v不能小于0
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("counter can't decrease")
+	}
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	c.values[key] += v
+	c.mutex.Unlock()
+}
+
+// Value 返回标签对应的计数
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) key(labelValues []string) string {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", c.metricName, len(c.labels), len(labelValues)))
+	}
+	return formatLabels(c.labels, labelValues)
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(w, c.metricName, c.help, "counter")
+	var keys []string
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(c.labels) == 0 {
+		keys = append(keys, "")
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, key, formatValue(c.values[key]))
+	}
+}
+
+// Histogram 统计观测值的分布，例如延迟
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram 创建并注册一个直方图，buckets为每个分桶的上界，为空的时候使用DefaultBuckets
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		buckets:    buckets,
+		counts:     make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatValue(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo 按照名字的顺序输出所有注册的指标
+func WriteTo(w io.Writer) {
+	mutex.Lock()
+	var all []metric
+	for _, m := range metrics {
+		all = append(all, m)
+	}
+	mutex.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].name() < all[j].name()
+	})
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// Handler 以prometheus的文本格式输出所有指标
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteTo(w)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_events_total", "events\nposted", "namespace", "result")
+	c.Inc("a", "ok")
+	c.Inc("a", "ok")
+	c.Add(3, `b"`, "error")
+	if v := c.Value("a", "ok"); v != 2 {
+		t.Errorf("expect 2, got %v", v)
+	}
+
+	buf := new(bytes.Buffer)
+	c.write(buf)
+	expect := `# HELP test_events_total events\nposted
+# TYPE test_events_total counter
+test_events_total{namespace="a",result="ok"} 2
+test_events_total{namespace="b\"",result="error"} 3
+`
+	if buf.String() != expect {
+		t.Errorf("expect:\n%s\ngot:\n%s", expect, buf)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := NewCounter("test_reconnects_total", "reconnects")
+	buf := new(bytes.Buffer)
+	c.write(buf)
+	if !strings.HasSuffix(buf.String(), "test_reconnects_total 0\n") {
+		t.Errorf("expect zero value, got:\n%s", buf)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "latency", []float64{1, 0.5})
+	h.Observe(0.2)
+	h.Observe(0.7)
+	h.Observe(3)
+
+	buf := new(bytes.Buffer)
+	h.write(buf)
+	expect := `# HELP test_latency_seconds latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.5"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.9
+test_latency_seconds_count 3
+`
+	if buf.String() != expect {
+		t.Errorf("expect:\n%s\ngot:\n%s", expect, buf)
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	NewCounter("test_dup_total", "dup")
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic on duplicate metric")
+		}
+	}()
+	NewCounter("test_dup_total", "dup")
+}
@@ -0,0 +1,96 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errAttachClosed = errors.New("attachment closed")
+)
+
+// attachment 是正在接收的附件，数据由ResponseReader边读边写入，
+// 读取的时候如果数据还没有到达会阻塞等待
+type attachment struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+
+	// 写入结束的原因，正常结束为io.EOF
+	err error
+	// 被读取方关闭之后丢弃后续的数据
+	closed bool
+	// 已经被指令引用
+	claimed bool
+}
+
+func newAttachment() *attachment {
+	a := new(attachment)
+	a.cond = sync.NewCond(&a.mutex)
+	return a
+}
+
+func (a *attachment) Write(p []byte) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed {
+		return 0, errAttachClosed
+	}
+	a.buf.Write(p)
+	a.cond.Broadcast()
+	return len(p), nil
+}
+
+// closeWrite 结束写入，err为nil表示数据完整
+func (a *attachment) closeWrite(err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.err != nil {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	a.err = err
+	a.cond.Broadcast()
+}
+
+func (a *attachment) done() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.err != nil
+}
+
+// Len 返回已经接收但是还没有被读取的字节数
+func (a *attachment) Len() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.buf.Len()
+}
+
+func (a *attachment) Read(p []byte) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for a.buf.Len() == 0 && a.err == nil && !a.closed {
+		a.cond.Wait()
+	}
+	if a.closed {
+		return 0, errAttachClosed
+	}
+	if a.buf.Len() == 0 {
+		return 0, a.err
+	}
+	return a.buf.Read(p)
+}
+
+func (a *attachment) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.closed = true
+	a.buf.Reset()
+	a.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,355 @@
+package proto
+
+import (
+	"reflect"
+	"sync"
+)
+
+// 设备端接口的namespace
+const (
+	NamespaceAudioPlayer        = "ai.dueros.device_interface.audio_player"
+	NamespaceVoiceInput         = "ai.dueros.device_interface.voice_input"
+	NamespaceVoiceOutput        = "ai.dueros.device_interface.voice_output"
+	NamespaceScreen             = "ai.dueros.device_interface.screen"
+	NamespaceScreenExtendedCard = "ai.dueros.device_interface.screen_extended_card"
+	NamespaceAlerts             = "ai.dueros.device_interface.alerts"
+	NamespaceSpeakerController  = "ai.dueros.device_interface.speaker_controller"
+	NamespaceSystem             = "ai.dueros.device_interface.system"
+	NamespaceTextInput          = "ai.dueros.device_interface.text_input"
+)
+
+// audio_player
+
+type ProgressReport struct {
+	ProgressReportDelayInMilliseconds    int64 `json:"progressReportDelayInMilliseconds,omitempty"`
+	ProgressReportIntervalInMilliseconds int64 `json:"progressReportIntervalInMilliseconds,omitempty"`
+}
+
+type Stream struct {
+	Url                   string          `json:"url"`
+	StreamFormat          string          `json:"streamFormat,omitempty"`
+	OffsetInMilliseconds  int64           `json:"offsetInMilliseconds"`
+	ExpiryTime            string          `json:"expiryTime,omitempty"`
+	ProgressReport        *ProgressReport `json:"progressReport,omitempty"`
+	Token                 string          `json:"token"`
+	ExpectedPreviousToken string          `json:"expectedPreviousToken,omitempty"`
+}
+
+type AudioItem struct {
+	AudioItemId string `json:"audioItemId"`
+	Stream      Stream `json:"stream"`
+}
+
+type PlayPayload struct {
+	PlayBehavior string    `json:"playBehavior"`
+	AudioItem    AudioItem `json:"audioItem"`
+}
+
+type StopPayload struct {
+}
+
+type ClearQueuePayload struct {
+	ClearBehavior string `json:"clearBehavior"`
+}
+
+// PlaybackEventPayload 用于PlaybackStarted, PlaybackFinished等播放事件
+type PlaybackEventPayload struct {
+	Token                string `json:"token"`
+	OffsetInMilliseconds int64  `json:"offsetInMilliseconds"`
+}
+
+type PlaybackStatePayload struct {
+	Token                string `json:"token"`
+	OffsetInMilliseconds int64  `json:"offsetInMilliseconds"`
+	PlayerActivity       string `json:"playerActivity"`
+}
+
+// voice_output
+
+type SpeakPayload struct {
+	Format string `json:"format"`
+	Url    string `json:"url"`
+	Token  string `json:"token"`
+}
+
+// SpeechEventPayload 用于SpeechStarted和SpeechFinished事件
+type SpeechEventPayload struct {
+	Token string `json:"token"`
+}
+
+type SpeechStatePayload struct {
+	Token                string `json:"token"`
+	OffsetInMilliseconds int64  `json:"offsetInMilliseconds"`
+	PlayerActivity       string `json:"playerActivity"`
+}
+
+// voice_input
+
+type ListenPayload struct {
+	TimeoutInMilliseconds int64 `json:"timeoutInMilliseconds"`
+}
+
+type ExpectSpeechPayload struct {
+	TimeoutInMilliseconds int64 `json:"timeoutInMilliseconds"`
+}
+
+type StopListenPayload struct {
+}
+
+// ListenStarted的倾听方式
+const (
+	// ProfileCloseTalk 按住说话，松开的时候结束
+	ProfileCloseTalk = "CLOSE_TALK"
+	// ProfileNearField 点击说话，由服务端判断什么时候结束
+	ProfileNearField = "NEAR_FIELD"
+	// ProfileFarField 唤醒词唤醒，由服务端判断什么时候结束
+	ProfileFarField = "FAR_FIELD"
+)
+
+type ListenStartedPayload struct {
+	Format  string `json:"format"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// screen
+
+type RenderVoiceInputTextPayload struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type Image struct {
+	Src string `json:"src"`
+}
+
+type Link struct {
+	Url        string `json:"url"`
+	AnchorText string `json:"anchorText,omitempty"`
+}
+
+type ListItem struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Image   *Image `json:"image,omitempty"`
+	Url     string `json:"url,omitempty"`
+}
+
+// RenderCard的卡片类型
+const (
+	// CardText 只有文本内容和链接
+	CardText = "TextCard"
+	// CardStandard 有标题、文本内容和一张图片
+	CardStandard = "StandardCard"
+	// CardList 是多个带有标题、内容和图片的条目
+	CardList = "ListCard"
+	// CardImageList 是多张图片
+	CardImageList = "ImageListCard"
+)
+
+type RenderCardPayload struct {
+	Token     string     `json:"token,omitempty"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	Image     *Image     `json:"image,omitempty"`
+	Link      *Link      `json:"link,omitempty"`
+	List      []ListItem `json:"list,omitempty"`
+	ImageList []Image    `json:"imageList,omitempty"`
+}
+
+// screen_extended_card
+
+type Provider struct {
+	Name string `json:"name"`
+	Logo *Image `json:"logo,omitempty"`
+}
+
+type Lyric struct {
+	Url    string `json:"url"`
+	Format string `json:"format"`
+}
+
+type PlayerInfoContent struct {
+	AudioItemId               string    `json:"audioItemId"`
+	Title                     string    `json:"title"`
+	TitleSubtext1             string    `json:"titleSubtext1"`
+	TitleSubtext2             string    `json:"titleSubtext2"`
+	Lyric                     *Lyric    `json:"lyric,omitempty"`
+	MediaLengthInMilliseconds int64     `json:"mediaLengthInMilliseconds"`
+	Art                       *Image    `json:"art,omitempty"`
+	Provider                  *Provider `json:"provider,omitempty"`
+}
+
+type PlayerControl struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Selected bool   `json:"selected"`
+}
+
+type RenderPlayerInfoPayload struct {
+	Token    string            `json:"token"`
+	Content  PlayerInfoContent `json:"content"`
+	Controls []PlayerControl   `json:"controls,omitempty"`
+}
+
+// alerts
+
+type SetAlertPayload struct {
+	Token         string `json:"token"`
+	Type          string `json:"type"`
+	ScheduledTime string `json:"scheduledTime"`
+}
+
+type DeleteAlertPayload struct {
+	Token string `json:"token"`
+}
+
+// AlertEventPayload 用于SetAlertSucceeded, AlertStarted等闹钟事件
+type AlertEventPayload struct {
+	Token string `json:"token"`
+}
+
+type Alert struct {
+	Token         string `json:"token"`
+	Type          string `json:"type"`
+	ScheduledTime string `json:"scheduledTime"`
+}
+
+type AlertsStatePayload struct {
+	AllAlerts    []Alert `json:"allAlerts"`
+	ActiveAlerts []Alert `json:"activeAlerts"`
+}
+
+// speaker_controller
+
+type SetVolumePayload struct {
+	Volume int `json:"volume"`
+}
+
+type AdjustVolumePayload struct {
+	Volume int `json:"volume"`
+}
+
+type SetMutePayload struct {
+	Mute bool `json:"mute"`
+}
+
+type VolumeStatePayload struct {
+	Volume int  `json:"volume"`
+	Muted  bool `json:"muted"`
+}
+
+// system
+
+// ExceptionEncountered的错误类型
+const (
+	ExceptionUnexpectedInformation = "UNEXPECTED_INFORMATION_RECEIVED"
+	ExceptionUnsupportedOperation  = "UNSUPPORTED_OPERATION"
+	ExceptionInternalError         = "INTERNAL_ERROR"
+)
+
+type ExceptionError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ExceptionEncounteredPayload struct {
+	UnparsedDirective string         `json:"unparsedDirective"`
+	Error             ExceptionError `json:"error"`
+}
+
+// Capability 描述设备支持的一个接口
+type Capability struct {
+	Type       string   `json:"type"`
+	Interface  string   `json:"interface"`
+	Version    string   `json:"version"`
+	Directives []string `json:"directives"`
+}
+
+type SynchronizeStatePayload struct {
+	Capabilities []Capability `json:"capabilities,omitempty"`
+}
+
+type ThrowExceptionPayload struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// text_input
+
+type TextInputPayload struct {
+	Query string `json:"query"`
+}
+
+var (
+	payloadMutex sync.RWMutex
+	payloadTypes = make(map[string]reflect.Type)
+)
+
+// RegisterPayload 注册namespace.name对应的payload类型，payload为该类型的零值或者指针
+func RegisterPayload(name string, payload interface{}) {
+	t := reflect.TypeOf(payload)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	payloadMutex.Lock()
+	payloadTypes[name] = t
+	payloadMutex.Unlock()
+}
+
+// NewPayload 返回namespace.name对应payload类型的新指针，未注册的返回nil
+func NewPayload(namespace, name string) interface{} {
+	payloadMutex.RLock()
+	t, ok := payloadTypes[namespace+"."+name]
+	payloadMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	return reflect.New(t).Interface()
+}
+
+func init() {
+	// directives
+	RegisterPayload(NamespaceAudioPlayer+".Play", PlayPayload{})
+	RegisterPayload(NamespaceAudioPlayer+".Stop", StopPayload{})
+	RegisterPayload(NamespaceAudioPlayer+".ClearQueue", ClearQueuePayload{})
+	RegisterPayload(NamespaceVoiceOutput+".Speak", SpeakPayload{})
+	RegisterPayload(NamespaceVoiceInput+".Listen", ListenPayload{})
+	RegisterPayload(NamespaceVoiceInput+".ExpectSpeech", ExpectSpeechPayload{})
+	RegisterPayload(NamespaceVoiceInput+".StopListen", StopListenPayload{})
+	RegisterPayload(NamespaceScreen+".RenderVoiceInputText", RenderVoiceInputTextPayload{})
+	RegisterPayload(NamespaceScreen+".RenderCard", RenderCardPayload{})
+	RegisterPayload(NamespaceScreenExtendedCard+".RenderPlayerInfo", RenderPlayerInfoPayload{})
+	RegisterPayload(NamespaceAlerts+".SetAlert", SetAlertPayload{})
+	RegisterPayload(NamespaceAlerts+".DeleteAlert", DeleteAlertPayload{})
+	RegisterPayload(NamespaceSpeakerController+".SetVolume", SetVolumePayload{})
+	RegisterPayload(NamespaceSpeakerController+".AdjustVolume", AdjustVolumePayload{})
+	RegisterPayload(NamespaceSpeakerController+".SetMute", SetMutePayload{})
+	RegisterPayload(NamespaceSystem+".ThrowException", ThrowExceptionPayload{})
+
+	// events
+	for _, name := range []string{"PlaybackStarted", "PlaybackStopped", "PlaybackPaused",
+		"PlaybackResumed", "PlaybackNearlyFinished", "PlaybackFinished",
+		"ProgressReportIntervalElapsed", "ProgressReportDelayElapsed"} {
+		RegisterPayload(NamespaceAudioPlayer+"."+name, PlaybackEventPayload{})
+	}
+	RegisterPayload(NamespaceVoiceOutput+".SpeechStarted", SpeechEventPayload{})
+	RegisterPayload(NamespaceVoiceOutput+".SpeechFinished", SpeechEventPayload{})
+	RegisterPayload(NamespaceVoiceInput+".ListenStarted", ListenStartedPayload{})
+	for _, name := range []string{"SetAlertSucceeded", "SetAlertFailed",
+		"DeleteAlertSucceeded", "DeleteAlertFailed", "AlertStarted", "AlertStopped"} {
+		RegisterPayload(NamespaceAlerts+"."+name, AlertEventPayload{})
+	}
+	RegisterPayload(NamespaceSpeakerController+".VolumeChanged", VolumeStatePayload{})
+	RegisterPayload(NamespaceSpeakerController+".MuteChanged", VolumeStatePayload{})
+	RegisterPayload(NamespaceSystem+".ExceptionEncountered", ExceptionEncounteredPayload{})
+	RegisterPayload(NamespaceSystem+".SynchronizeState", SynchronizeStatePayload{})
+	RegisterPayload(NamespaceTextInput+".TextInput", TextInputPayload{})
+
+	// client context
+	RegisterPayload(NamespaceAudioPlayer+".PlaybackState", PlaybackStatePayload{})
+	RegisterPayload(NamespaceVoiceOutput+".SpeechState", SpeechStatePayload{})
+	RegisterPayload(NamespaceAlerts+".AlertsState", AlertsStatePayload{})
+	RegisterPayload(NamespaceSpeakerController+".VolumeState", VolumeStatePayload{})
+}
@@ -7,7 +7,9 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
@@ -16,6 +18,8 @@ import (
 
 var (
 	ErrEmptyBody = errors.New("empty body")
+	// ErrUnsupportedDirective 表示设备不支持的指令
+	ErrUnsupportedDirective = errors.New("unsupported directive")
 )
 
 type MessageHeader struct {
@@ -29,7 +33,11 @@ type Message struct {
 	Header      MessageHeader `json:"header"`
 	Payload     interface{}   `json:"payload"`
 	PayloadJSON gjson.Result  `json:"-"`
-	Attach      io.ReadCloser `json:"-"`
+	// RawJSON 是指令的原始内容
+	RawJSON string `json:"-"`
+	// Attach 是第一个附件，Attachments包含了所有按照Content-ID索引的附件
+	Attach      io.ReadCloser            `json:"-"`
+	Attachments map[string]io.ReadCloser `json:"-"`
 }
 
 func NewMessage(name string, payload interface{}) *Message {
@@ -47,6 +55,17 @@ func NewMessage(name string, payload interface{}) *Message {
 	return m
 }
 
+// NewExceptionEncountered 创建上报指令处理失败的事件，unparsed为指令的原始内容
+func NewExceptionEncountered(unparsed, errorType string, err error) *Message {
+	return NewMessage(NamespaceSystem+".ExceptionEncountered", &ExceptionEncounteredPayload{
+		UnparsedDirective: unparsed,
+		Error: ExceptionError{
+			Type:    errorType,
+			Message: err.Error(),
+		},
+	})
+}
+
 func (m *Message) UnmarshalJSON(b []byte) error {
 	root := gjson.ParseBytes(b)
 	err := json.Unmarshal([]byte(root.Get("header").Raw), &m.Header)
@@ -55,7 +74,10 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 	}
 
 	m.PayloadJSON = root.Get("payload")
-	if m.Payload != nil {
+	if m.Payload == nil {
+		m.Payload = NewPayload(m.Header.Namespace, m.Header.Name)
+	}
+	if m.Payload != nil && m.PayloadJSON.Exists() {
 		err = json.Unmarshal([]byte(m.PayloadJSON.Raw), m.Payload)
 		if err != nil {
 			return err
@@ -64,18 +86,87 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// StatusError 表示服务端返回了非200的状态码
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// DirectiveError 表示无法解析的指令，Raw为指令的原始内容
+type DirectiveError struct {
+	Raw string
+	Err error
+}
+
+func (e *DirectiveError) Error() string {
+	return "bad directive: " + e.Err.Error()
+}
+
+// AttachRefs 返回payload中所有cid:引用的Content-ID
+func (m *Message) AttachRefs() []string {
+	var refs []string
+	var walk func(v gjson.Result)
+	walk = func(v gjson.Result) {
+		if v.IsObject() || v.IsArray() {
+			v.ForEach(func(_, value gjson.Result) bool {
+				walk(value)
+				return true
+			})
+			return
+		}
+		if v.Type == gjson.String && strings.HasPrefix(v.Str, "cid:") {
+			refs = append(refs, strings.TrimPrefix(v.Str, "cid:"))
+		}
+	}
+	walk(m.PayloadJSON)
+	return refs
+}
+
+func contentID(h textproto.MIMEHeader) string {
+	id := h.Get("Content-ID")
+	return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+type readResult struct {
+	m   *Message
+	err error
+}
+
+// ResponseReader 读取multipart格式的响应，
+// 二进制的part按照Content-ID索引，指令中的cid:引用会被解析成对应的附件。
+// 响应在后台持续读取，附件可以在接收完毕之前开始读取
 type ResponseReader struct {
 	*http.Response
 	r *multipart.Reader
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// 已经解析但是还没有被读取的指令
+	queue []readResult
+	err   error
+
+	// 只在后台读取的goroutine里面访问
+	attachments map[string]*attachment
+	// 已经接收但是还没有被指令引用的附件，按照到达的顺序
+	unclaimed []string
 }
 
+// maxUnclaimedSize 是没有被指令引用的附件最多缓存的字节数，
+// 下行通道的响应会一直读取，不能无限制地缓存用不到的附件
+const maxUnclaimedSize = 4 << 20
+
 func NewResponseReader(resp *http.Response) (*ResponseReader, error) {
 	if resp.StatusCode == 204 {
 		return nil, ErrEmptyBody
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 	ctype := resp.Header.Get("Content-Type")
 	ctype = strings.Replace(ctype, "/json", "-json", -1)
@@ -88,54 +179,191 @@ func NewResponseReader(resp *http.Response) (*ResponseReader, error) {
 	}
 
 	boundary := params["boundary"]
-	r := multipart.NewReader(resp.Body, boundary)
-	return &ResponseReader{
-		Response: resp,
-		r:        r,
-	}, nil
+	r := &ResponseReader{
+		Response:    resp,
+		r:           multipart.NewReader(resp.Body, boundary),
+		attachments: make(map[string]*attachment),
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	go r.readLoop()
+	return r, nil
+}
+
+func (r *ResponseReader) attachment(id string) *attachment {
+	a, ok := r.attachments[id]
+	if !ok {
+		a = newAttachment()
+		r.attachments[id] = a
+	}
+	return a
+}
+
+// release 附件接收完毕并且被指令引用之后不再需要索引
+func (r *ResponseReader) release(id string, a *attachment) {
+	if a.claimed && a.done() {
+		delete(r.attachments, id)
+	}
+}
+
+// claim 标记附件被指令引用
+func (r *ResponseReader) claim(id string) *attachment {
+	a := r.attachment(id)
+	a.claimed = true
+	r.removeUnclaimed(id)
+	return a
+}
+
+func (r *ResponseReader) removeUnclaimed(id string) bool {
+	for i, unclaimed := range r.unclaimed {
+		if unclaimed == id {
+			r.unclaimed = append(r.unclaimed[:i], r.unclaimed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// discard 丢弃没有被引用的附件
+func (r *ResponseReader) discard(id string) {
+	if a, ok := r.attachments[id]; ok {
+		a.Close()
+		delete(r.attachments, id)
+	}
 }
 
-func (r *ResponseReader) ReadJSON() (*gjson.Result, error) {
+// discardUnclaimed 丢弃在当前指令之前就已经接收完但是没有被引用的附件
+func (r *ResponseReader) discardUnclaimed() {
+	for _, id := range r.unclaimed {
+		r.discard(id)
+	}
+	r.unclaimed = nil
+}
+
+// trimUnclaimed 没有被引用的附件超过maxUnclaimedSize的时候丢弃最早的附件
+func (r *ResponseReader) trimUnclaimed() {
+	size := 0
+	for _, id := range r.unclaimed {
+		size += r.attachments[id].Len()
+	}
+	for size > maxUnclaimedSize {
+		id := r.unclaimed[0]
+		size -= r.attachments[id].Len()
+		r.discard(id)
+		r.unclaimed = r.unclaimed[1:]
+	}
+}
+
+// readPart 读取下一个part，JSON格式的part解析成指令，其余的按照Content-ID写入对应的附件
+func (r *ResponseReader) readPart() (*Message, error) {
 	p, err := r.r.NextPart()
 	if err != nil {
 		return nil, err
 	}
 	defer p.Close()
-	mtype, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
-	if err != nil {
-		return nil, err
-	}
+
+	mtype, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
 	if mtype != "application/json" {
-		return nil, errors.Errorf("application/json mime type expceted, actual:%s", mtype)
+		id := contentID(p.Header)
+		if id == "" {
+			return nil, nil
+		}
+		// 同一个Content-ID的附件重复出现的时候只保留最后一个
+		if r.removeUnclaimed(id) {
+			r.discard(id)
+		}
+		a := r.attachment(id)
+		if a.claimed {
+			_, err = io.Copy(a, p)
+			if err == errAttachClosed {
+				err = nil
+			}
+			a.closeWrite(err)
+			r.release(id, a)
+			return nil, err
+		}
+		// 附件先于引用它的指令到达，缓存到下一个指令，超过maxUnclaimedSize的附件直接丢弃
+		n, err := io.Copy(a, io.LimitReader(p, maxUnclaimedSize+1))
+		if err != nil || n > maxUnclaimedSize {
+			r.discard(id)
+			return nil, err
+		}
+		a.closeWrite(nil)
+		r.unclaimed = append(r.unclaimed, id)
+		r.trimUnclaimed()
+		return nil, nil
 	}
 
 	buf, err := ioutil.ReadAll(p)
 	if err != nil {
 		return nil, err
 	}
-	result := gjson.ParseBytes(buf)
-	return &result, nil
-}
-
-func (r *ResponseReader) ReadDirective() (*Message, error) {
-	root, err := r.ReadJSON()
-	if err != nil {
-		return nil, err
-	}
+	root := gjson.ParseBytes(buf)
 	m := new(Message)
 	err = json.Unmarshal([]byte(root.Get("directive").Raw), m)
 	if err != nil {
-		return nil, err
+		return nil, &DirectiveError{Raw: string(buf), Err: err}
+	}
+	m.RawJSON = root.Get("directive").Raw
+	for _, id := range m.AttachRefs() {
+		a := r.claim(id)
+		if m.Attachments == nil {
+			m.Attachments = make(map[string]io.ReadCloser)
+		}
+		m.Attachments[id] = a
+		if m.Attach == nil {
+			m.Attach = a
+		}
+		r.release(id, a)
 	}
+	r.discardUnclaimed()
 	return m, nil
 }
 
-func (r *ResponseReader) ReadAttach() (io.ReadCloser, error) {
-	p, err := r.r.NextPart()
-	if err != nil {
-		return nil, err
+func (r *ResponseReader) readLoop() {
+	for {
+		m, err := r.readPart()
+		if m == nil && err == nil {
+			continue
+		}
+		_, bad := err.(*DirectiveError)
+		r.mutex.Lock()
+		if err != nil && !bad {
+			r.err = err
+		} else {
+			r.queue = append(r.queue, readResult{m: m, err: err})
+		}
+		r.cond.Broadcast()
+		r.mutex.Unlock()
+		if r.err != nil {
+			break
+		}
+	}
+
+	// 没有接收完的附件不会再有数据了
+	err := r.err
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	for _, a := range r.attachments {
+		a.closeWrite(err)
+	}
+}
+
+// ReadDirective 按照顺序返回下一个指令，指令引用的附件可能还在接收中。
+// 返回*DirectiveError的时候表示当前指令无法解析，可以继续读取下一个指令，
+// 其它错误表示响应已经无法继续读取
+func (r *ResponseReader) ReadDirective() (*Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for len(r.queue) == 0 && r.err == nil {
+		r.cond.Wait()
+	}
+	if len(r.queue) > 0 {
+		result := r.queue[0]
+		r.queue = r.queue[1:]
+		return result.m, result.err
 	}
-	return p, nil
+	return nil, r.err
 }
 
 func (r *ResponseReader) Close() error {
@@ -0,0 +1,283 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalTypedPayload(t *testing.T) {
+	raw := `{
+		"header": {"namespace": "ai.dueros.device_interface.audio_player", "name": "Play", "messageId": "1"},
+		"payload": {
+			"playBehavior": "REPLACE_ALL",
+			"audioItem": {
+				"audioItemId": "item",
+				"stream": {
+					"url": "http://example.com/a.mp3",
+					"token": "tk",
+					"progressReport": {"progressReportIntervalInMilliseconds": 1000}
+				}
+			}
+		}
+	}`
+	m := new(Message)
+	err := json.Unmarshal([]byte(raw), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, ok := m.Payload.(*PlayPayload)
+	if !ok {
+		t.Fatalf("expect *PlayPayload, got %T", m.Payload)
+	}
+	if payload.AudioItem.Stream.Url != "http://example.com/a.mp3" || payload.AudioItem.Stream.Token != "tk" {
+		t.Errorf("bad stream: %+v", payload.AudioItem.Stream)
+	}
+	if payload.AudioItem.Stream.ProgressReport.ProgressReportIntervalInMilliseconds != 1000 {
+		t.Errorf("bad progress report: %+v", payload.AudioItem.Stream.ProgressReport)
+	}
+}
+
+func TestUnmarshalUnknownPayload(t *testing.T) {
+	raw := `{"header": {"namespace": "unknown", "name": "Foo"}, "payload": {"a": 1}}`
+	m := new(Message)
+	err := json.Unmarshal([]byte(raw), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Payload != nil {
+		t.Errorf("expect nil payload, got %T", m.Payload)
+	}
+	if m.PayloadJSON.Get("a").Int() != 1 {
+		t.Errorf("bad payload json: %s", m.PayloadJSON.Raw)
+	}
+}
+
+func newMultipartResponse(t *testing.T, parts func(w *multipart.Writer)) *ResponseReader {
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	parts(w)
+	w.Close()
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"multipart/related; boundary=" + w.Boundary()}},
+		Body:       ioutil.NopCloser(buf),
+	}
+	r, err := NewResponseReader(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func writePart(w *multipart.Writer, ctype, cid, body string) {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", ctype)
+	if cid != "" {
+		h.Set("Content-ID", "<"+cid+">")
+	}
+	p, _ := w.CreatePart(h)
+	io.WriteString(p, body)
+}
+
+func speakDirective(cid string) string {
+	return `{"directive": {"header": {"namespace": "ai.dueros.device_interface.voice_output", "name": "Speak"},
+		"payload": {"format": "AUDIO_MPEG", "url": "cid:` + cid + `", "token": "` + cid + `"}}}`
+}
+
+func readAttach(t *testing.T, m *Message) string {
+	if m.Attach == nil {
+		t.Fatalf("%s has no attachment", m.Header.Name)
+	}
+	buf, _ := ioutil.ReadAll(m.Attach)
+	return string(buf)
+}
+
+func TestReadDirectiveAttachments(t *testing.T) {
+	r := newMultipartResponse(t, func(w *multipart.Writer) {
+		// 第二个指令的附件先到达
+		writePart(w, "application/json", "", speakDirective("a"))
+		writePart(w, "application/octet-stream", "b", "audio-b")
+		writePart(w, "application/json", "", speakDirective("b"))
+		writePart(w, "application/octet-stream", "a", "audio-a")
+		writePart(w, "application/json", "", `{"directive": `)
+		writePart(w, "application/json", "", `{"directive": {"header": {"namespace": "ai.dueros.device_interface.voice_input", "name": "StopListen"}, "payload": {}}}`)
+	})
+
+	m, err := r.ReadDirective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAttach(t, m); got != "audio-a" {
+		t.Errorf("expect audio-a, got %s", got)
+	}
+	m, err = r.ReadDirective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAttach(t, m); got != "audio-b" {
+		t.Errorf("expect audio-b, got %s", got)
+	}
+
+	_, err = r.ReadDirective()
+	if _, ok := err.(*DirectiveError); !ok {
+		t.Fatalf("expect *DirectiveError, got %v", err)
+	}
+
+	m, err = r.ReadDirective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Name != "StopListen" {
+		t.Errorf("expect StopListen, got %s", m.Header.Name)
+	}
+	_, err = r.ReadDirective()
+	if err != io.EOF {
+		t.Errorf("expect EOF, got %v", err)
+	}
+	_, err = r.ReadDirective()
+	if err != io.EOF {
+		t.Errorf("expect EOF again, got %v", err)
+	}
+}
+
+func TestReadDirectiveStreamingAttachment(t *testing.T) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"multipart/related; boundary=" + w.Boundary()}},
+		Body:       pr,
+	}
+	r, err := NewResponseReader(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	next := make(chan bool)
+	go func() {
+		writePart(w, "application/json", "", speakDirective("a"))
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-ID", "<a>")
+		p, _ := w.CreatePart(h)
+		io.WriteString(p, "first")
+		// 等待第一段数据被读到之后再发送剩余的数据
+		<-next
+		io.WriteString(p, "second")
+		w.Close()
+		pw.Close()
+	}()
+
+	m, err := r.ReadDirective()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(m.Attach, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "first" {
+		t.Errorf("expect first, got %s", buf)
+	}
+	next <- true
+	rest, err := ioutil.ReadAll(m.Attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "second" {
+		t.Errorf("expect second, got %s", rest)
+	}
+}
+
+// readAllParts 在当前goroutine里面读取所有的part，返回读到的指令
+func readAllParts(t *testing.T, parts func(w *multipart.Writer)) (*ResponseReader, []*Message) {
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	parts(w)
+	w.Close()
+	r := &ResponseReader{
+		r:           multipart.NewReader(buf, w.Boundary()),
+		attachments: make(map[string]*attachment),
+	}
+	var directives []*Message
+	for {
+		m, err := r.readPart()
+		if err == io.EOF {
+			return r, directives
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			directives = append(directives, m)
+		}
+	}
+}
+
+func TestUnclaimedAttachments(t *testing.T) {
+	big := strings.Repeat("x", maxUnclaimedSize/2+1)
+	cases := []struct {
+		name  string
+		parts func(w *multipart.Writer)
+		// 读取所有的part之后还在缓存的附件
+		left []string
+	}{
+		{"unreferenced before directive", func(w *multipart.Writer) {
+			writePart(w, "application/octet-stream", "x", "audio-x")
+			writePart(w, "application/json", "", speakDirective("a"))
+			writePart(w, "application/octet-stream", "a", "audio-a")
+		}, nil},
+		{"unreferenced at end", func(w *multipart.Writer) {
+			writePart(w, "application/json", "", speakDirective("a"))
+			writePart(w, "application/octet-stream", "a", "audio-a")
+			writePart(w, "application/octet-stream", "x", "audio-x")
+		}, []string{"x"}},
+		{"too large", func(w *multipart.Writer) {
+			writePart(w, "application/octet-stream", "x", strings.Repeat("x", maxUnclaimedSize+1))
+		}, nil},
+		{"over total size", func(w *multipart.Writer) {
+			writePart(w, "application/octet-stream", "x", big)
+			writePart(w, "application/octet-stream", "y", big)
+			writePart(w, "application/octet-stream", "z", "audio-z")
+		}, []string{"y", "z"}},
+		{"duplicate", func(w *multipart.Writer) {
+			writePart(w, "application/octet-stream", "x", "audio-x")
+			writePart(w, "application/octet-stream", "x", "audio-x")
+		}, []string{"x"}},
+	}
+	for _, c := range cases {
+		r, _ := readAllParts(t, c.parts)
+		var left []string
+		for id := range r.attachments {
+			left = append(left, id)
+		}
+		sort.Strings(left)
+		if len(left)+len(c.left)+len(r.unclaimed) != 0 && (!reflect.DeepEqual(left, c.left) || !reflect.DeepEqual(r.unclaimed, c.left)) {
+			t.Errorf("%s: expect %v left, got %v %v", c.name, c.left, left, r.unclaimed)
+		}
+	}
+}
+
+func TestAttachmentBeforeDirective(t *testing.T) {
+	_, directives := readAllParts(t, func(w *multipart.Writer) {
+		writePart(w, "application/octet-stream", "a", "audio-a")
+		writePart(w, "application/json", "", speakDirective("a"))
+	})
+	if len(directives) != 1 {
+		t.Fatalf("expect 1 directive, got %d", len(directives))
+	}
+	if got := readAttach(t, directives[0]); got != "audio-a" {
+		t.Errorf("expect audio-a, got %s", got)
+	}
+}
@@ -1,78 +1,393 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	snowboy "github.com/brentnd/go-snowboy"
 	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/iface"
+	"github.com/icexin/dueros/logger"
+	"github.com/icexin/dueros/proto"
 )
 
 var (
 	wakeupSensitivity = flag.Float64("sens", 0.46, "wakeup detector sensitivity")
+	hotwordsFlag      = flag.String("hotwords", "", "hotwords of keyword wakeup, format: model:sensitivity:action[,...], "+
+		"action is listen|stop or a registered custom action, default -wakeup_model with -sens and listen")
+	wakeupResource = flag.String("wakeup_resource", "resource/common.res", "resource file of snowboy")
+	wakeupModel    = flag.String("wakeup_model", "resource/wakeup.pmdl", "model of the default hotword")
 )
 
+// 唤醒词检测到之后执行的动作
+const (
+	// ActionListen 开始倾听
+	ActionListen = "listen"
+	// ActionStop 打断正在播报的语音并停止正在播放的音乐，不需要和服务端交互
+	ActionStop = "stop"
+)
+
+// Hotword 是一个唤醒词模型，检测到之后执行Action对应的动作
+type Hotword struct {
+	Model string `json:"model"`
+	// Sensitivity 为nil的时候使用--sens，0是合法的灵敏度，不能当成没有设置
+	Sensitivity *float64 `json:"sensitivity,omitempty"`
+	Action      string   `json:"action"`
+}
+
+// String 返回--hotwords中一个唤醒词的格式
+func (h Hotword) String() string {
+	sens := ""
+	if h.Sensitivity != nil {
+		sens = strconv.FormatFloat(*h.Sensitivity, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%s:%s:%s", h.Model, sens, h.Action)
+}
+
+// WakeupAction 是检测到唤醒词之后执行的自定义动作，model为唤醒词的模型文件
+type WakeupAction func(model string)
+
+var wakeupActions = map[string]WakeupAction{
+	ActionStop: stopAudio,
+}
+
+// RegisterWakeupAction 注册自定义的唤醒词动作，需要在NewWakeupListener之前调用
+func RegisterWakeupAction(name string, action WakeupAction) {
+	wakeupActions[name] = action
+}
+
+// stopAudio 打断正在播报的语音并停止播放音乐
+func stopAudio(model string) {
+	// 先打断播报，被打断的播报结束之后不会恢复播放音乐
+	if voiceOutput, err := iface.DefaultRegistry.VoiceOutput(); err == nil {
+		voiceOutput.Interrupt()
+	} else {
+		logger.Warnf("stop speech:%s", err)
+	}
+	player, err := iface.DefaultRegistry.AudioPlayer()
+	if err != nil {
+		logger.Warnf("stop audio:%s", err)
+		return
+	}
+	player.Stop(nil)
+}
+
+// parseHotwords 解析model:sensitivity:action格式的唤醒词列表，sensitivity和action可以省略
+func parseHotwords(s string) ([]Hotword, error) {
+	var hotwords []Hotword
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("bad hotword %q", item)
+		}
+		sens := *wakeupSensitivity
+		h := Hotword{
+			Model:       parts[0],
+			Sensitivity: &sens,
+			Action:      ActionListen,
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			var err error
+			sens, err = strconv.ParseFloat(parts[1], 64)
+			if err != nil || sens < 0 || sens > 1 {
+				return nil, fmt.Errorf("bad sensitivity of hotword %q", item)
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			h.Action = parts[2]
+		}
+		if _, ok := wakeupActions[h.Action]; !ok && h.Action != ActionListen {
+			return nil, fmt.Errorf("unknown action of hotword %q", item)
+		}
+		hotwords = append(hotwords, h)
+	}
+	if len(hotwords) == 0 {
+		return nil, fmt.Errorf("no hotwords in %q", s)
+	}
+	return hotwords, nil
+}
+
 const (
 	KeyboardListener = "keyboard"
 	KeywordListener  = "keyword"
+	EvdevListener    = "evdev"
+	GPIOListener     = "gpio"
+	HTTPListener     = "http"
+	SignalListener   = "signal"
 )
 
+// Wakeup 是一次唤醒
+type Wakeup struct {
+	// 唤醒时录音的位置
+	Position audio.Position
+	// 倾听方式，例如proto.ProfileFarField
+	Profile string
+	// 按住说话的时候在松开按键时被关闭
+	Release <-chan struct{}
+	// 唤醒方式，例如KeywordListener
+	Method string
+}
+
 type WakeupListener interface {
-	ListenAndWakeup()
+	// ListenAndWakeup 阻塞直到被唤醒，唤醒方式不能再工作或者被关闭的时候返回错误
+	ListenAndWakeup() (Wakeup, error)
 	Close() error
 }
 
+// 唤醒方式可以通过method:profile指定倾听方式
+var listenProfiles = map[string]string{
+	"tap":  proto.ProfileNearField,
+	"hold": proto.ProfileCloseTalk,
+	"far":  proto.ProfileFarField,
+}
+
+// holdable 是可以按住说话的唤醒方式
+type holdable interface {
+	enableHold() error
+}
+
+// profileWakeupListener 修改唤醒的倾听方式
+type profileWakeupListener struct {
+	WakeupListener
+	profile string
+}
+
+func (p *profileWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	w, err := p.WakeupListener.ListenAndWakeup()
+	w.Profile = p.profile
+	return w, err
+}
+
+func withProfile(l WakeupListener, profile string) (WakeupListener, error) {
+	if profile != proto.ProfileCloseTalk {
+		return &profileWakeupListener{WakeupListener: l, profile: profile}, nil
+	}
+	h, ok := l.(holdable)
+	if !ok {
+		return nil, errors.New("hold to talk is not supported")
+	}
+	return l, h.enableHold()
+}
+
 type keyboardWakeupListener struct {
 }
 
-func newKeyboardWakeupListener() WakeupListener {
-	return new(keyboardWakeupListener)
+func newKeyboardWakeupListener() (WakeupListener, error) {
+	return new(keyboardWakeupListener), nil
 }
 
-func (k keyboardWakeupListener) ListenAndWakeup() {
-	fmt.Scanln()
+func (k keyboardWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	// 标准输入被关闭之后不能再唤醒
+	if _, err := fmt.Scanln(); err == io.EOF {
+		return Wakeup{}, errors.New("stdin closed")
+	}
+	return Wakeup{
+		Position: audio.DefaultRecorder.Position(),
+		Profile:  proto.ProfileNearField,
+	}, nil
 }
 
 func (k keyboardWakeupListener) Close() error {
 	return nil
 }
 
+// keywordWakeupListener 一直从自己的录音流中检测唤醒词，和语音识别同时进行，
+// 因此在播报和播放音乐的时候也可以被唤醒
 type keywordWakeupListener struct {
 	detector     snowboy.Detector
-	recordReader io.ReadCloser
+	recordReader *audio.Stream
+	woken        bool
+	// 检测到唤醒词时录音的位置
+	wakeupPos audio.Position
 }
 
-func newKeywordWakeupListener() WakeupListener {
+func newKeywordWakeupListener(hotwords []Hotword) WakeupListener {
 	k := &keywordWakeupListener{
-		detector: snowboy.NewDetector("resource/common.res"),
+		detector: snowboy.NewDetector(*wakeupResource),
+	}
+	for _, h := range hotwords {
+		hotword := snowboy.Hotword{
+			Model:       h.Model,
+			Sensitivity: float32(*h.Sensitivity),
+			Name:        h.Model,
+		}
+		if h.Action == ActionListen {
+			k.detector.HandleFunc(hotword, k.onWakeup)
+			continue
+		}
+		// 其他动作执行完之后继续检测唤醒词
+		action := wakeupActions[h.Action]
+		k.detector.HandleFunc(hotword, func(model string) {
+			logger.Infof("hotword %s detected", model)
+			action(model)
+		})
 	}
-	k.detector.HandleFunc(snowboy.NewHotword("resource/wakeup.pmdl", float32(*wakeupSensitivity)), k.onWakeup)
 	return k
 }
 
-func (k *keywordWakeupListener) onWakeup(string) {
-	fmt.Println(">>> wakeup")
-	k.recordReader.Close()
+func (k *keywordWakeupListener) onWakeup(model string) {
+	fmt.Printf(">>> wakeup by %s\n", model)
+	k.wakeupPos = k.recordReader.Position()
+	k.woken = true
 }
 
-func (k *keywordWakeupListener) ListenAndWakeup() {
-	k.recordReader = audio.NewRecordStream()
-	k.detector.ReadAndDetect(k.recordReader)
+func (k *keywordWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	if k.recordReader == nil {
+		k.recordReader = audio.NewRecordStreamAt(audio.DefaultRecorder.Position())
+	}
+	buf := make([]byte, 2048)
+	k.woken = false
+	for !k.woken {
+		_, err := k.recordReader.Read(buf)
+		if err != nil {
+			return Wakeup{}, fmt.Errorf("read wakeup stream: %s", err)
+		}
+		err = k.detector.Detect(buf)
+		if err != nil {
+			logger.Errorf("detect wakeup error:%s", err)
+		}
+	}
 	k.detector.Reset()
+	return Wakeup{Position: k.wakeupPos, Profile: proto.ProfileFarField}, nil
 }
 
 func (k *keywordWakeupListener) Close() error {
+	if k.recordReader != nil {
+		k.recordReader.Close()
+	}
 	return k.detector.Close()
 }
 
-func NewWakeupListener(method string) WakeupListener {
-	switch method {
-	case KeyboardListener:
-		return newKeyboardWakeupListener()
-	case KeywordListener:
-		return newKeywordWakeupListener()
-	default:
-		panic("wakeup method not found: " + method)
+func newDefaultKeywordWakeupListener() (WakeupListener, error) {
+	hotwords := []Hotword{{
+		Model:       *wakeupModel,
+		Sensitivity: wakeupSensitivity,
+		Action:      ActionListen,
+	}}
+	if *hotwordsFlag != "" {
+		var err error
+		hotwords, err = parseHotwords(*hotwordsFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newKeywordWakeupListener(hotwords), nil
+}
+
+var wakeupListeners = map[string]func() (WakeupListener, error){
+	KeyboardListener: newKeyboardWakeupListener,
+	KeywordListener:  newDefaultKeywordWakeupListener,
+	EvdevListener:    newEvdevWakeupListener,
+	GPIOListener:     newGPIOWakeupListener,
+	HTTPListener:     newHTTPWakeupListener,
+	SignalListener:   newSignalWakeupListener,
+}
+
+// RegisterWakeupListener 注册新的唤醒方式，需要在NewWakeupListener之前调用
+func RegisterWakeupListener(method string, factory func() (WakeupListener, error)) {
+	wakeupListeners[method] = factory
+}
+
+// NewWakeupListener 创建method对应的唤醒方式，多个方式用逗号分隔，任意一个都可以唤醒，
+// 每个方式可以用method:profile指定倾听方式，profile为tap|hold|far，例如keyword,evdev:hold
+func NewWakeupListener(method string) (WakeupListener, error) {
+	items, err := splitWakeupMethods(method)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []WakeupListener
+	for _, item := range items {
+		l, err := newWakeupListener(item)
+		if err != nil {
+			closeWakeupListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiWakeupListener(listeners), nil
+}
+
+// splitWakeupMethods 拆分逗号分隔的唤醒方式，同一个唤醒方式只能使用一次
+func splitWakeupMethods(method string) ([]string, error) {
+	var items []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(method, ",") {
+		item = strings.TrimSpace(item)
+		name := strings.SplitN(item, ":", 2)[0]
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate wakeup method %s", name)
+		}
+		seen[name] = true
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseWakeupMethod 解析method:profile格式的唤醒方式，没有指定profile的时候返回空
+func parseWakeupMethod(item string) (name, profile string, err error) {
+	parts := strings.SplitN(item, ":", 2)
+	name = parts[0]
+	if _, ok := wakeupListeners[name]; !ok {
+		return "", "", fmt.Errorf("wakeup method not found: %q", name)
+	}
+	if len(parts) == 2 {
+		var ok bool
+		profile, ok = listenProfiles[parts[1]]
+		if !ok {
+			return "", "", fmt.Errorf("unknown listen profile %q of wakeup method %s", parts[1], name)
+		}
+	}
+	return name, profile, nil
+}
+
+func newWakeupListener(item string) (WakeupListener, error) {
+	name, profile, err := parseWakeupMethod(item)
+	if err != nil {
+		return nil, err
+	}
+	l, err := wakeupListeners[name]()
+	if err != nil {
+		return nil, fmt.Errorf("wakeup method %s: %s", name, err)
+	}
+	if profile != "" {
+		pl, err := withProfile(l, profile)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("wakeup method %s: %s", name, err)
+		}
+		l = pl
+	}
+	return &methodWakeupListener{WakeupListener: l, method: name}, nil
+}
+
+// methodWakeupListener 在唤醒中记录唤醒方式
+type methodWakeupListener struct {
+	WakeupListener
+	method string
+}
+
+func (m *methodWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	w, err := m.WakeupListener.ListenAndWakeup()
+	if err != nil {
+		return w, fmt.Errorf("wakeup method %s: %s", m.method, err)
+	}
+	w.Method = m.method
+	return w, nil
+}
+
+func closeWakeupListeners(listeners []WakeupListener) {
+	for _, l := range listeners {
+		l.Close()
 	}
 }
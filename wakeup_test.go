@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/icexin/dueros/proto"
+)
+
+func TestParseHotwords(t *testing.T) {
+	defer resetFlags()()
+	*wakeupSensitivity = 0.46
+	RegisterWakeupAction("lights", func(model string) {})
+	defer delete(wakeupActions, "lights")
+
+	cases := []struct {
+		s        string
+		hotwords []string
+		ok       bool
+	}{
+		{"a.pmdl", []string{"a.pmdl:0.46:listen"}, true},
+		{"a.pmdl:0.5", []string{"a.pmdl:0.5:listen"}, true},
+		{"a.pmdl:0", []string{"a.pmdl:0:listen"}, true},
+		{"a.pmdl::stop", []string{"a.pmdl:0.46:stop"}, true},
+		{" a.pmdl:0.4:listen , b.pmdl:0.6:stop,,c.pmdl::lights ",
+			[]string{"a.pmdl:0.4:listen", "b.pmdl:0.6:stop", "c.pmdl:0.46:lights"}, true},
+		{"a.pmdl:1.5", nil, false},
+		{"a.pmdl:-0.1", nil, false},
+		{"a.pmdl:high", nil, false},
+		{"a.pmdl:0.5:jump", nil, false},
+		{"a.pmdl:0.5:stop:x", nil, false},
+		{" , ", nil, false},
+	}
+	for _, c := range cases {
+		hotwords, err := parseHotwords(c.s)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expect ok %v, got %v", c.s, c.ok, err)
+			continue
+		}
+		var got []string
+		for _, h := range hotwords {
+			got = append(got, h.String())
+		}
+		if !reflect.DeepEqual(got, c.hotwords) {
+			t.Errorf("%q: expect %v, got %v", c.s, c.hotwords, got)
+		}
+	}
+}
+
+func TestParseWakeupMethod(t *testing.T) {
+	cases := []struct {
+		item    string
+		name    string
+		profile string
+		ok      bool
+	}{
+		{"keyword", KeywordListener, "", true},
+		{"evdev:hold", EvdevListener, proto.ProfileCloseTalk, true},
+		{"keyword:far", KeywordListener, proto.ProfileFarField, true},
+		{"http:tap", HTTPListener, proto.ProfileNearField, true},
+		{"keyword:hold", KeywordListener, proto.ProfileCloseTalk, true},
+		{"gpio:", "", "", false},
+		{"evdev:press", "", "", false},
+		{"morse", "", "", false},
+		{"", "", "", false},
+	}
+	for _, c := range cases {
+		name, profile, err := parseWakeupMethod(c.item)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expect ok %v, got %v", c.item, c.ok, err)
+			continue
+		}
+		if name != c.name || profile != c.profile {
+			t.Errorf("%q: expect %s %s, got %s %s", c.item, c.name, c.profile, name, profile)
+		}
+	}
+}
+
+// fakeWakeupListener 依次返回wakeups，之后返回err
+type fakeWakeupListener struct {
+	wakeups []Wakeup
+	err     error
+	closed  bool
+}
+
+func (f *fakeWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	if len(f.wakeups) == 0 {
+		return Wakeup{}, f.err
+	}
+	w := f.wakeups[0]
+	f.wakeups = f.wakeups[1:]
+	return w, nil
+}
+
+func (f *fakeWakeupListener) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestTriggerWakeupListenerError(t *testing.T) {
+	errRead := errors.New("read error")
+	l := newTriggerWakeupListener(true)
+	l.fail(errRead)
+	l.fail(errors.New("ignored"))
+	if _, err := l.ListenAndWakeup(); err != errRead {
+		t.Errorf("expect %v, got %v", errRead, err)
+	}
+	l.Close()
+	l.Close()
+	if _, err := l.ListenAndWakeup(); err != errWakeupClosed {
+		t.Errorf("expect %v, got %v", errWakeupClosed, err)
+	}
+}
+
+func TestMultiWakeupListenerError(t *testing.T) {
+	errRead := errors.New("read error")
+	keyword := &fakeWakeupListener{wakeups: []Wakeup{{Method: KeywordListener}}, err: errRead}
+	m := newMultiWakeupListener([]WakeupListener{keyword})
+	w, err := m.ListenAndWakeup()
+	if err != nil || w.Method != KeywordListener {
+		t.Errorf("expect keyword wakeup, got %+v %v", w, err)
+	}
+	// 唤醒方式出错之后返回错误，而不是一直等待
+	if _, err = m.ListenAndWakeup(); err != errRead {
+		t.Errorf("expect %v, got %v", errRead, err)
+	}
+	m.Close()
+	if !keyword.closed {
+		t.Error("expect listeners closed")
+	}
+	if _, err = m.ListenAndWakeup(); err != errWakeupClosed {
+		t.Errorf("expect %v, got %v", errWakeupClosed, err)
+	}
+}
+
+func TestMethodWakeupListener(t *testing.T) {
+	l := &methodWakeupListener{
+		WakeupListener: &fakeWakeupListener{wakeups: []Wakeup{{}}, err: errors.New("read error")},
+		method:         GPIOListener,
+	}
+	w, err := l.ListenAndWakeup()
+	if err != nil || w.Method != GPIOListener {
+		t.Errorf("expect gpio wakeup, got %+v %v", w, err)
+	}
+	_, err = l.ListenAndWakeup()
+	if err == nil || err.Error() != "wakeup method gpio: read error" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWithProfile(t *testing.T) {
+	cases := []struct {
+		name     string
+		listener WakeupListener
+		profile  string
+		ok       bool
+	}{
+		{"keyword far", new(keywordWakeupListener), proto.ProfileFarField, true},
+		{"keyword tap", new(keywordWakeupListener), proto.ProfileNearField, true},
+		{"keyword hold", new(keywordWakeupListener), proto.ProfileCloseTalk, false},
+		{"evdev hold", newTriggerWakeupListener(true), proto.ProfileCloseTalk, true},
+		{"http hold", newTriggerWakeupListener(false), proto.ProfileCloseTalk, false},
+		{"http far", newTriggerWakeupListener(false), proto.ProfileFarField, true},
+	}
+	for _, c := range cases {
+		l, err := withProfile(c.listener, c.profile)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expect ok %v, got %v", c.name, c.ok, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		// 按住说话由唤醒方式自己设置，其他的倾听方式覆盖唤醒的profile
+		if c.profile == proto.ProfileCloseTalk {
+			if l != c.listener || !c.listener.(*triggerWakeupListener).hold {
+				t.Errorf("%s: expect hold enabled on the listener", c.name)
+			}
+			continue
+		}
+		if p, ok := l.(*profileWakeupListener); !ok || p.profile != c.profile {
+			t.Errorf("%s: expect profile %s, got %#v", c.name, c.profile, l)
+		}
+	}
+}
+
+func TestProfileWakeup(t *testing.T) {
+	l, err := withProfile(&fakeWakeupListener{wakeups: []Wakeup{{Profile: proto.ProfileFarField}}}, proto.ProfileNearField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := l.ListenAndWakeup()
+	if err != nil || w.Profile != proto.ProfileNearField {
+		t.Errorf("expect near field wakeup, got %+v %v", w, err)
+	}
+}
+
+func TestSplitWakeupMethods(t *testing.T) {
+	cases := []struct {
+		method string
+		items  []string
+		ok     bool
+	}{
+		{"keyword", []string{"keyword"}, true},
+		{" keyword , evdev:hold ", []string{"keyword", "evdev:hold"}, true},
+		{"http,http:hold", nil, false},
+		{"keyword,evdev,keyword:far", nil, false},
+	}
+	for _, c := range cases {
+		items, err := splitWakeupMethods(c.method)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expect ok %v, got %v", c.method, c.ok, err)
+			continue
+		}
+		if !reflect.DeepEqual(items, c.items) {
+			t.Errorf("%q: expect %v, got %v", c.method, c.items, items)
+		}
+	}
+}
+
+func TestHTTPWakeup(t *testing.T) {
+	post := func(origin string) int {
+		r := httptest.NewRequest("POST", "http://pi.local:8080/wakeup", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handleWakeup(w, r)
+		return w.Code
+	}
+	if code := post(""); code != http.StatusNotFound {
+		t.Errorf("expect 404 without http wakeup, got %d", code)
+	}
+
+	// 创建多个http唤醒方式不会重复注册/wakeup
+	first, _ := newHTTPWakeupListener()
+	l, _ := newHTTPWakeupListener()
+	first.Close()
+	if httpWakeup.t != l {
+		t.Error("expect closing an old listener to keep the current one")
+	}
+	if code := post("http://evil.example.com"); code != http.StatusForbidden {
+		t.Errorf("expect 403 for other origins, got %d", code)
+	}
+	w := httptest.NewRecorder()
+	handleWakeup(w, httptest.NewRequest("GET", "/wakeup", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expect 405 for GET, got %d", w.Code)
+	}
+	l.Close()
+	if code := post(""); code != http.StatusNotFound {
+		t.Errorf("expect 404 after close, got %d", code)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/dueros/audio"
+	"github.com/icexin/dueros/hub"
+	"github.com/icexin/dueros/proto"
+)
+
+var (
+	evdevDevice   = flag.String("evdev_device", "/dev/input/event0", "input device of evdev wakeup")
+	evdevKey      = flag.Int("evdev_key", 0, "key code of evdev wakeup, 0 for any key")
+	gpioPin       = flag.Int("gpio_pin", 17, "pin number of gpio wakeup")
+	gpioActiveLow = flag.Bool("gpio_active_low", true, "button of gpio wakeup pulls the pin low when pressed")
+)
+
+// errWakeupClosed 表示唤醒方式已经被关闭
+var errWakeupClosed = errors.New("wakeup listener closed")
+
+// triggerWakeupListener 在trigger被调用的时候唤醒，用于按键、HTTP和信号这类外部触发的唤醒方式
+type triggerWakeupListener struct {
+	ch        chan Wakeup
+	errc      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	closeFunc func() error
+
+	// 可以检测到按键松开的唤醒方式才能按住说话
+	canHold bool
+
+	mutex   sync.Mutex
+	hold    bool
+	release chan struct{}
+}
+
+func newTriggerWakeupListener(canHold bool) *triggerWakeupListener {
+	return &triggerWakeupListener{
+		ch:      make(chan Wakeup, 1),
+		errc:    make(chan error, 1),
+		done:    make(chan struct{}),
+		canHold: canHold,
+	}
+}
+
+func (t *triggerWakeupListener) enableHold() error {
+	if !t.canHold {
+		return errors.New("hold to talk is not supported")
+	}
+	t.mutex.Lock()
+	t.hold = true
+	t.mutex.Unlock()
+	return nil
+}
+
+// trigger 记录触发时录音的位置，上一次触发还没有被处理的时候忽略
+func (t *triggerWakeupListener) trigger() {
+	w := Wakeup{
+		Position: audio.DefaultRecorder.Position(),
+		Profile:  proto.ProfileNearField,
+	}
+	t.mutex.Lock()
+	if t.hold {
+		t.releaseLocked()
+		t.release = make(chan struct{})
+		w.Profile = proto.ProfileCloseTalk
+		w.Release = t.release
+	}
+	t.mutex.Unlock()
+	select {
+	case t.ch <- w:
+	default:
+	}
+}
+
+// untrigger 在按键松开的时候被调用，结束按住说话
+func (t *triggerWakeupListener) untrigger() {
+	t.mutex.Lock()
+	t.releaseLocked()
+	t.mutex.Unlock()
+}
+
+func (t *triggerWakeupListener) releaseLocked() {
+	if t.release != nil {
+		close(t.release)
+		t.release = nil
+	}
+}
+
+// fail 在读取按键出错的时候被调用，ListenAndWakeup返回err
+func (t *triggerWakeupListener) fail(err error) {
+	select {
+	case t.errc <- err:
+	default:
+	}
+}
+
+func (t *triggerWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	select {
+	case w := <-t.ch:
+		return w, nil
+	case err := <-t.errc:
+		return Wakeup{}, err
+	case <-t.done:
+		return Wakeup{}, errWakeupClosed
+	}
+}
+
+func (t *triggerWakeupListener) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.closeFunc != nil {
+			err = t.closeFunc()
+		}
+	})
+	return err
+}
+
+// evdev事件类型，见linux/input-event-codes.h
+const (
+	evKey       = 0x01
+	keyReleased = 0
+	keyPressed  = 1
+)
+
+// newEvdevWakeupListener 在按下evdev设备的按键时唤醒，GPIO按键可以通过gpio-keys驱动映射成evdev设备
+func newEvdevWakeupListener() (WakeupListener, error) {
+	f, err := os.Open(*evdevDevice)
+	if err != nil {
+		return nil, err
+	}
+	t := newTriggerWakeupListener(true)
+	t.closeFunc = f.Close
+	go func() {
+		// struct input_event {struct timeval time; __u16 type; __u16 code; __s32 value;}
+		size := int(unsafe.Sizeof(syscall.Timeval{}))
+		buf := make([]byte, size+8)
+		for {
+			_, err := io.ReadFull(f, buf)
+			if err != nil {
+				t.fail(fmt.Errorf("read %s: %s", *evdevDevice, err))
+				return
+			}
+			typ := binary.LittleEndian.Uint16(buf[size:])
+			code := binary.LittleEndian.Uint16(buf[size+2:])
+			value := int32(binary.LittleEndian.Uint32(buf[size+4:]))
+			if typ != evKey || (*evdevKey != 0 && int(code) != *evdevKey) {
+				continue
+			}
+			switch value {
+			case keyPressed:
+				t.trigger()
+			case keyReleased:
+				t.untrigger()
+			}
+		}
+	}()
+	return t, nil
+}
+
+// gpioSetupRetries 是export之后设置gpio方向的最多尝试次数
+const gpioSetupRetries = 20
+
+// newGPIOWakeupListener 通过sysfs轮询GPIO的电平，按键按下的时候唤醒
+func newGPIOWakeupListener() (WakeupListener, error) {
+	dir := fmt.Sprintf("/sys/class/gpio/gpio%d", *gpioPin)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err = ioutil.WriteFile("/sys/class/gpio/export", []byte(fmt.Sprint(*gpioPin)), 0200)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// export之后udev需要一点时间修改gpio文件的权限，写入失败的时候重试
+	var err error
+	for i := 0; i < gpioSetupRetries; i++ {
+		err = ioutil.WriteFile(filepath.Join(dir, "direction"), []byte("in"), 0644)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	valueFile := filepath.Join(dir, "value")
+	pressed := func() (bool, error) {
+		buf, err := ioutil.ReadFile(valueFile)
+		if err != nil {
+			return false, err
+		}
+		high := strings.TrimSpace(string(buf)) == "1"
+		return high != *gpioActiveLow, nil
+	}
+
+	t := newTriggerWakeupListener(true)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		last := false
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+			}
+			curr, err := pressed()
+			if err != nil {
+				t.fail(fmt.Errorf("read gpio %d: %s", *gpioPin, err))
+				return
+			}
+			if curr && !last {
+				t.trigger()
+			} else if !curr && last {
+				t.untrigger()
+			}
+			last = curr
+		}
+	}()
+	return t, nil
+}
+
+// httpWakeup 是当前的http唤醒方式，/wakeup只在setuphttp中注册一次
+var httpWakeup struct {
+	sync.Mutex
+	t *triggerWakeupListener
+}
+
+// newHTTPWakeupListener 在收到POST /wakeup请求的时候唤醒，用于智能家居等外部系统触发倾听
+func newHTTPWakeupListener() (WakeupListener, error) {
+	t := newTriggerWakeupListener(false)
+	t.closeFunc = func() error {
+		httpWakeup.Lock()
+		if httpWakeup.t == t {
+			httpWakeup.t = nil
+		}
+		httpWakeup.Unlock()
+		return nil
+	}
+	httpWakeup.Lock()
+	httpWakeup.t = t
+	httpWakeup.Unlock()
+	return t, nil
+}
+
+// handleWakeup 处理POST /wakeup，没有使用http唤醒方式的时候返回404
+func handleWakeup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hub.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	httpWakeup.Lock()
+	t := httpWakeup.t
+	httpWakeup.Unlock()
+	if t == nil {
+		http.Error(w, "http wakeup not enabled", http.StatusNotFound)
+		return
+	}
+	t.trigger()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// newSignalWakeupListener 在收到SIGUSR1的时候唤醒
+func newSignalWakeupListener() (WakeupListener, error) {
+	t := newTriggerWakeupListener(false)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	t.closeFunc = func() error {
+		signal.Stop(ch)
+		return nil
+	}
+	go func() {
+		for {
+			select {
+			case <-ch:
+				t.trigger()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// multiWakeupListener 同时使用多个唤醒方式，任意一个唤醒即返回，任意一个出错的时候返回错误
+type multiWakeupListener struct {
+	listeners []WakeupListener
+	ch        chan wakeupResult
+	done      chan struct{}
+}
+
+type wakeupResult struct {
+	w   Wakeup
+	err error
+}
+
+func newMultiWakeupListener(listeners []WakeupListener) WakeupListener {
+	m := &multiWakeupListener{
+		listeners: listeners,
+		ch:        make(chan wakeupResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.run(l)
+	}
+	return m
+}
+
+func (m *multiWakeupListener) run(l WakeupListener) {
+	for {
+		w, err := l.ListenAndWakeup()
+		select {
+		case m.ch <- wakeupResult{w, err}:
+		case <-m.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiWakeupListener) ListenAndWakeup() (Wakeup, error) {
+	select {
+	case r := <-m.ch:
+		return r.w, r.err
+	case <-m.done:
+		return Wakeup{}, errWakeupClosed
+	}
+}
+
+func (m *multiWakeupListener) Close() error {
+	close(m.done)
+	var err error
+	for _, l := range m.listeners {
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
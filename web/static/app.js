@@ -0,0 +1,238 @@
+// 通过/ws接收设备推送的事件，渲染语音识别结果、卡片和正在播放的音乐
+(function () {
+  "use strict";
+
+  var $ = function (id) { return document.getElementById(id); };
+
+  // 创建元素，text通过textContent设置，不会被当成html
+  function el(tag, className, text) {
+    var e = document.createElement(tag);
+    if (className) e.className = className;
+    if (text) e.textContent = text;
+    return e;
+  }
+
+  // 只显示http和https的图片和链接
+  function safeURL(url) {
+    return /^https?:\/\//i.test(url || "") ? url : "";
+  }
+
+  function image(img, className) {
+    var src = safeURL(img && img.src);
+    if (!src) return null;
+    var e = el("img", className);
+    e.src = src;
+    e.alt = "";
+    return e;
+  }
+
+  function link(url, text) {
+    var href = safeURL(url);
+    if (!href) return null;
+    var a = el("a", "", text || href);
+    a.href = href;
+    a.target = "_blank";
+    a.rel = "noopener";
+    return a;
+  }
+
+  function append(parent, child) {
+    if (child) parent.appendChild(child);
+  }
+
+  // 连接状态
+  function renderConnection(data) {
+    var dot = $("connection");
+    dot.classList.toggle("online", data.connected);
+    dot.title = data.connected ? "已连接" : "未连接";
+  }
+
+  // 对话和语音识别
+  function renderDialogStart() {
+    $("voice").className = "listening";
+    $("voice-state").textContent = "正在倾听";
+    $("voice-text").textContent = "";
+  }
+
+  function renderDialogEnd() {
+    $("voice").className = "idle";
+    $("voice-state").textContent = "等待唤醒";
+  }
+
+  function renderVoiceInputText(data) {
+    var text = $("voice-text");
+    text.textContent = data.text;
+    text.className = data.type === "FINAL" ? "" : "intermediate";
+    if (data.type === "FINAL") {
+      $("voice-state").textContent = "倾听完毕";
+    }
+  }
+
+  // 卡片
+  var cardRenderers = {
+    TextCard: function (card, root) {
+      append(root, el("p", "", card.content));
+    },
+    StandardCard: function (card, root) {
+      append(root, el("h2", "", card.title));
+      append(root, image(card.image));
+      append(root, el("p", "", card.content));
+    },
+    ListCard: function (card, root) {
+      var ul = el("ul");
+      (card.list || []).forEach(function (item) {
+        var li = el("li");
+        append(li, image(item.image));
+        var body = el("div");
+        var title = el("div", "title", item.title);
+        var a = link(item.url, item.title);
+        if (a) {
+          title.textContent = "";
+          title.appendChild(a);
+        }
+        body.appendChild(title);
+        append(body, el("div", "content", item.content));
+        li.appendChild(body);
+        ul.appendChild(li);
+      });
+      root.appendChild(ul);
+    },
+    ImageListCard: function (card, root) {
+      var images = el("div", "images");
+      (card.imageList || []).forEach(function (img) {
+        append(images, image(img));
+      });
+      root.appendChild(images);
+    }
+  };
+
+  function renderCard(card) {
+    var root = $("card");
+    root.textContent = "";
+    var render = cardRenderers[card.type] || cardRenderers.TextCard;
+    render(card, root);
+    if (card.link) {
+      var p = el("p");
+      append(p, link(card.link.url, card.link.anchorText));
+      root.appendChild(p);
+    }
+    root.hidden = false;
+  }
+
+  // 音乐播放
+  var player = {
+    length: 0,
+    offset: 0,
+    // 收到offset时的本地时间，播放的时候据此推算当前的进度
+    at: 0,
+    state: "FINISHED"
+  };
+
+  function formatTime(ms) {
+    var s = Math.floor(ms / 1000);
+    var m = Math.floor(s / 60);
+    s = s % 60;
+    return m + ":" + (s < 10 ? "0" : "") + s;
+  }
+
+  function renderPlayerInfo(data) {
+    var content = data.content || {};
+    $("player-title").textContent = content.title || "";
+    $("player-subtitle").textContent = [content.titleSubtext1, content.titleSubtext2]
+      .filter(Boolean).join(" / ");
+    $("player-provider").textContent = content.provider ? content.provider.name : "";
+    var art = $("player-art");
+    var src = safeURL(content.art && content.art.src);
+    if (src) {
+      art.src = src;
+    } else {
+      art.removeAttribute("src");
+    }
+    player.length = content.mediaLengthInMilliseconds || 0;
+    $("player").hidden = false;
+    renderProgress();
+  }
+
+  function renderPlayerState(data) {
+    player.state = data.state;
+    player.offset = data.offsetInMilliseconds || 0;
+    player.at = Date.now();
+    $("player-state").textContent = {
+      PLAYING: "正在播放",
+      PAUSED: "已暂停",
+      STOPED: "已停止",
+      FINISHED: "播放完毕"
+    }[data.state] || data.state;
+    renderProgress();
+  }
+
+  function currentOffset() {
+    if (player.state !== "PLAYING") return player.offset;
+    return player.offset + Date.now() - player.at;
+  }
+
+  function renderProgress() {
+    var offset = currentOffset();
+    if (player.length > 0) {
+      offset = Math.min(offset, player.length);
+      $("player-bar").style.width = (offset * 100 / player.length) + "%";
+    }
+    $("player-offset").textContent = formatTime(offset);
+    $("player-length").textContent = formatTime(player.length);
+  }
+
+  // 定期从/api/status同步播放进度，修正本地推算的误差
+  function syncStatus() {
+    fetch("/api/status").then(function (resp) {
+      return resp.json();
+    }).then(function (status) {
+      if (status.player) renderPlayerState(status.player);
+    }).catch(function () {});
+  }
+
+  $("player-controls").addEventListener("click", function (e) {
+    var action = e.target.getAttribute("data-action");
+    if (!action) return;
+    fetch("/api/player/" + action, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" }
+    }).then(function (resp) {
+      return resp.json();
+    }).then(function (status) {
+      if (status.state) renderPlayerState(status);
+    }).catch(function () {});
+  });
+
+  var handlers = {
+    connection: renderConnection,
+    dialogStart: renderDialogStart,
+    dialogEnd: renderDialogEnd,
+    voiceInputText: renderVoiceInputText,
+    renderCard: renderCard,
+    playerInfo: renderPlayerInfo,
+    playerState: renderPlayerState
+  };
+
+  function connect() {
+    var proto = location.protocol === "https:" ? "wss://" : "ws://";
+    var ws = new WebSocket(proto + location.host + "/ws");
+    ws.onopen = syncStatus;
+    ws.onmessage = function (msg) {
+      var e = JSON.parse(msg.data);
+      var handler = handlers[e.type];
+      if (handler) handler(e.data || {});
+    };
+    ws.onclose = function () {
+      renderConnection({ connected: false });
+      setTimeout(connect, 3000);
+    };
+  }
+
+  setInterval(function () {
+    if (player.state === "PLAYING") renderProgress();
+  }, 500);
+  setInterval(function () {
+    if (player.state === "PLAYING") syncStatus();
+  }, 5000);
+  connect();
+})();
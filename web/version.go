@@ -0,0 +1,7 @@
+//go:build !go1.16
+// +build !go1.16
+
+package web
+
+// 网页的文件通过go:embed打包进程序，低版本的Go在这里给出明确的编译错误
+var _ = dueros_requires_go1_16_or_later
@@ -0,0 +1,23 @@
+//go:build go1.16
+// +build go1.16
+
+// Package web 是设备自带的网页，通过/ws实时显示语音识别的结果、卡片和正在播放的音乐
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler 返回网页的静态文件
+func Handler() http.Handler {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	cases := []struct {
+		path   string
+		expect string
+	}{
+		{"/", `<script src="app.js">`},
+		{"/app.js", `"/ws"`},
+		{"/style.css", "#player-bar"},
+	}
+	h := Handler()
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		if w.Code != 200 || !strings.Contains(string(body), c.expect) {
+			t.Errorf("%s: unexpected response %d %.100s", c.path, w.Code, body)
+		}
+	}
+}